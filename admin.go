@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diametric/rustcon/middleware"
+	"github.com/diametric/rustcon/scheduler"
+	"github.com/diametric/rustcon/stats"
+	"github.com/diametric/rustcon/version"
+	"github.com/diametric/rustcon/webrcon"
+	"github.com/gomodule/redigo/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultAdminListen = "localhost:9274"
+	adminCheckTimeout  = 2 * time.Second
+)
+
+// readinessProbe checks rustcon is connected to RCON and can reach the
+// services it writes to.
+type readinessProbe struct {
+	rcon        *webrcon.RconClient
+	statsclient *stats.Client
+	pool        *redis.Pool
+	influx      bool
+}
+
+// adminServer serves the health, readiness and introspection endpoints.
+type adminServer struct {
+	*readinessProbe
+	tag              string
+	listen           string
+	pprof            bool
+	started          time.Time
+	schedulers       []*scheduler.Scheduler
+	queues           []string
+	queuesPrefix     string
+	dynamicQueueKey  string
+	callbackQueueKey string
+}
+
+// adminCheck is the result of a single readiness check.
+type adminCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Took  string `json:"took"`
+}
+
+// usesRedis returns whether anything in the config talks to redis.
+func usesRedis(config *Config) bool {
+	return config.EnableRedisQueue || config.GlobalsConfig.Backend == "redis" || config.SinksConfig.RedisStream.Enabled
+}
+
+func buildReadinessProbe(config *Config, rcon *webrcon.RconClient, statsclient *stats.Client, test bool) *readinessProbe {
+	probe := &readinessProbe{
+		rcon:        rcon,
+		statsclient: statsclient,
+		influx:      config.EnableInfluxStats && !test && statsclient != nil,
+	}
+
+	if usesRedis(config) {
+		probe.pool = middleware.NewPool(
+			config.RedisConfig.Host,
+			config.RedisConfig.Port,
+			config.RedisConfig.Database,
+			config.RedisConfig.Password)
+	}
+
+	return probe
+}
+
+func buildAdminServer(tag string, config *Config, probe *readinessProbe, schedulers []*scheduler.Scheduler) *adminServer {
+	if !config.AdminConfig.Enabled {
+		return nil
+	}
+
+	server := &adminServer{
+		readinessProbe: probe,
+		tag:            tag,
+		listen:         config.AdminConfig.Listen,
+		pprof:          config.AdminConfig.Pprof,
+		started:        time.Now(),
+		schedulers:     schedulers,
+	}
+
+	if server.listen == "" {
+		server.listen = defaultAdminListen
+	}
+
+	if config.EnableRedisQueue {
+		for _, queue := range config.StaticQueues {
+			server.queues = append(server.queues,
+				strings.ReplaceAll(fmt.Sprintf("%s:%s", config.QueuesPrefix, queue), "{tag}", tag))
+		}
+		server.queuesPrefix = config.QueuesPrefix
+		server.dynamicQueueKey = config.DynamicQueueKey
+		server.callbackQueueKey = strings.ReplaceAll(config.CallbackQueueKey, "{tag}", tag)
+	}
+
+	return server
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(data, '\n'))
+}
+
+// redisDo runs a single command on the probe's own pool, so a busy middleware
+// can't hold up the checks.
+func (a *readinessProbe) redisDo(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	conn, err := a.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return redis.DoWithTimeout(conn, adminCheckTimeout, command, args...)
+}
+
+func runCheck(check func() error) adminCheck {
+	start := time.Now()
+	err := check()
+
+	result := adminCheck{OK: err == nil, Took: time.Since(start).String()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// handleHealthz reports the process is up and serving. It doesn't check any
+// dependencies, so a restart is only triggered by rustcon itself being stuck.
+func (a *adminServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "ok",
+		"uptime": time.Since(a.started).Truncate(time.Second).String(),
+	})
+}
+
+// check checks RCON is connected, and redis and InfluxDB are reachable when
+// they're used.
+func (a *readinessProbe) check(ctx context.Context) (bool, map[string]adminCheck) {
+	ctx, cancel := context.WithTimeout(ctx, adminCheckTimeout)
+	defer cancel()
+
+	checks := map[string]adminCheck{
+		"rcon": runCheck(func() error {
+			if !a.rcon.Connected() {
+				return fmt.Errorf("not connected")
+			}
+			return nil
+		}),
+	}
+
+	if a.pool != nil {
+		checks["redis"] = runCheck(func() error {
+			_, err := a.redisDo(ctx, "PING")
+			return err
+		})
+	}
+
+	if a.influx {
+		checks["influx"] = runCheck(func() error {
+			return a.statsclient.Ping(ctx)
+		})
+	}
+
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.OK
+	}
+
+	return ready, checks
+}
+
+// handleReadyz returns the readiness checks, with a 503 if any failed.
+func (a *adminServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready, checks := a.check(r.Context())
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeAdminJSON(w, status, map[string]interface{}{
+		"ready":  ready,
+		"checks": checks,
+	})
+}
+
+// queueSizes returns the length of every redis queue, and of the alert
+// dispatcher's queues.
+func (a *adminServer) queueSizes(ctx context.Context) map[string]interface{} {
+	sizes := make(map[string]interface{})
+
+	if a.statsclient != nil && a.statsclient.Dispatcher != nil {
+		sizes["alerts"] = a.statsclient.Dispatcher.QueueSizes()
+	}
+
+	if a.pool == nil || (len(a.queues) == 0 && a.dynamicQueueKey == "" && a.callbackQueueKey == "") {
+		return sizes
+	}
+
+	queues := append([]string{}, a.queues...)
+	if a.dynamicQueueKey != "" {
+		dynamic, err := redis.Strings(a.redisDo(ctx, "SMEMBERS", a.dynamicQueueKey))
+		if err != nil {
+			sizes["error"] = err.Error()
+			return sizes
+		}
+		for _, queue := range dynamic {
+			queues = append(queues, strings.ReplaceAll(fmt.Sprintf("%s:%s", a.queuesPrefix, queue), "{tag}", a.tag))
+		}
+	}
+	if a.callbackQueueKey != "" {
+		queues = append(queues, a.callbackQueueKey)
+	}
+
+	lengths := make(map[string]int)
+	for _, queue := range queues {
+		length, err := redis.Int(a.redisDo(ctx, "LLEN", queue))
+		if err != nil {
+			sizes["error"] = err.Error()
+			break
+		}
+		lengths[queue] = length
+	}
+	sizes["redis"] = lengths
+
+	return sizes
+}
+
+// handleState dumps the internal state: the registered stats, scheduled jobs,
+// pending RCON callbacks, cached responses and queue sizes.
+func (a *adminServer) handleState(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), adminCheckTimeout)
+	defer cancel()
+
+	jobs := make(map[string][]scheduler.JobStats)
+	for _, s := range a.schedulers {
+		jobs[s.Name] = append(jobs[s.Name], s.Stats()...)
+	}
+
+	state := map[string]interface{}{
+		"tag":     a.tag,
+		"version": version.BuildVersion,
+		"started": a.started,
+		"uptime":  time.Since(a.started).Truncate(time.Second).String(),
+		"rcon": map[string]interface{}{
+			"connected":         a.rcon.Connected(),
+			"stats":             a.rcon.StatsSnapshot(),
+			"pending_callbacks": a.rcon.PendingCallbacks(),
+			"cache":             a.rcon.CacheEntries(),
+		},
+		"schedulers": jobs,
+		"queues":     a.queueSizes(ctx),
+	}
+
+	if a.statsclient != nil {
+		state["stats"] = a.statsclient.StatStates()
+	}
+
+	writeAdminJSON(w, http.StatusOK, state)
+}
+
+// Serve serves the admin endpoints until done is closed.
+func (a *adminServer) Serve(done chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	defer wg.Done()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", a.handleHealthz)
+	mux.HandleFunc("/readyz", a.handleReadyz)
+	mux.HandleFunc("/debug/state", a.handleState)
+	if a.pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	server := &http.Server{Addr: a.listen, Handler: mux}
+
+	go func() {
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	zap.S().Infof("Serving admin endpoints on %s", a.listen)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		zap.S().Errorf("Admin listener failed: %s", err)
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix prefixes the environment variables overriding config settings,
+// with __ separating the keys of nested settings, e.g. RUSTCON_REDIS__HOSTNAME.
+const envPrefix = "RUSTCON_"
+
+// includeKey lists the files, globs or directories merged into a config.
+const includeKey = "include"
+
+// configExtensions are the config formats, by extension. Anything else is
+// read as JSON.
+var configExtensions = map[string]string{
+	".json": "json",
+	".conf": "json",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".toml": "toml",
+}
+
+// readconfig loads the config, also returning the raw decoded tree for
+// validation. An empty filename loads the config from the environment alone.
+func readconfig(filename string) (*Config, interface{}, error) {
+	tree := make(map[string]interface{})
+	if filename != "" {
+		var err error
+		tree, err = readConfigTree(filename, make(map[string]bool))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	configType := reflect.TypeOf(Config{})
+	if err := applyEnvOverrides(tree, os.Environ(), configType); err != nil {
+		return nil, nil, err
+	}
+
+	raw := coerceConfig(interpolateEnv(tree), configType)
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := Config{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, nil, fmt.Errorf("config error: %s", err)
+	}
+
+	return &config, raw, nil
+}
+
+func loadconfig(filename string) (*Config, error) {
+	config, _, err := readconfig(filename)
+	return config, err
+}
+
+// readConfigTree parses a config file, and deep merges its includes into it.
+func readConfigTree(filename string, seen map[string]bool) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if seen[abs] {
+		return nil, fmt.Errorf("%s is included more than once", filename)
+	}
+	seen[abs] = true
+
+	tree, err := parseConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	includes, err := configIncludes(filename, tree[includeKey])
+	if err != nil {
+		return nil, err
+	}
+	delete(tree, includeKey)
+
+	for _, include := range includes {
+		included, err := readConfigTree(include, seen)
+		if err != nil {
+			return nil, err
+		}
+		tree = mergeConfig(tree, included).(map[string]interface{})
+	}
+
+	return tree, nil
+}
+
+func parseConfigFile(filename string) (map[string]interface{}, error) {
+	file, err := saneOpen(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree interface{}
+	switch configExtensions[strings.ToLower(filepath.Ext(filename))] {
+	case "yaml":
+		if err := yaml.Unmarshal(data, &tree); err != nil {
+			return nil, fmt.Errorf("%s: YAML parse error: %s", filename, err)
+		}
+	case "toml":
+		var table map[string]interface{}
+		if err := toml.Unmarshal(data, &table); err != nil {
+			return nil, fmt.Errorf("%s: TOML parse error: %s", filename, err)
+		}
+		tree = table
+	default:
+		if err := json.Unmarshal(data, &tree); err != nil {
+			return nil, fmt.Errorf("%s: JSON parse error: %s", filename, err)
+		}
+	}
+
+	if tree == nil {
+		return make(map[string]interface{}), nil
+	}
+
+	object, ok := normalizeConfig(tree).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: the config must be an object", filename)
+	}
+
+	return object, nil
+}
+
+// normalizeConfig converts the maps and slices of the YAML and TOML decoders
+// to the types encoding/json uses.
+func normalizeConfig(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			object[fmt.Sprint(k)] = normalizeConfig(item)
+		}
+		return object
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = normalizeConfig(item)
+		}
+		return v
+	case []map[string]interface{}:
+		array := make([]interface{}, len(v))
+		for i, item := range v {
+			array[i] = normalizeConfig(item)
+		}
+		return array
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeConfig(item)
+		}
+		return v
+	}
+
+	return value
+}
+
+// configIncludes expands the include setting, a path or list of paths
+// relative to the including file. Each path is a file, a glob, or a directory
+// to include every config file in. Matches are included in sorted order.
+func configIncludes(filename string, include interface{}) ([]string, error) {
+	var patterns []string
+	switch v := include.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		patterns = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: include must be a path or a list of paths", filename)
+			}
+			patterns = append(patterns, s)
+		}
+	default:
+		return nil, fmt.Errorf("%s: include must be a path or a list of paths", filename)
+	}
+
+	var includes []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+
+		if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+			pattern = filepath.Join(pattern, "*")
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include %s: %s", filename, pattern, err)
+		}
+		sort.Strings(matches)
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			if _, ok := configExtensions[strings.ToLower(filepath.Ext(match))]; !ok {
+				continue
+			}
+			includes = append(includes, match)
+		}
+	}
+
+	return includes, nil
+}
+
+// mergeConfig deep merges override into base. Objects are merged key by key,
+// lists are appended to, so included files can add stats, and anything else
+// is replaced.
+func mergeConfig(base interface{}, override interface{}) interface{} {
+	switch o := override.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			return o
+		}
+		for k, v := range o {
+			if existing, ok := lookupKey(b, k); ok {
+				b[existing] = mergeConfig(b[existing], v)
+			} else {
+				b[k] = v
+			}
+		}
+		return b
+	case []interface{}:
+		if b, ok := base.([]interface{}); ok {
+			return append(b, o...)
+		}
+	}
+
+	return override
+}
+
+// lookupKey finds key in object, case-insensitively like encoding/json.
+func lookupKey(object map[string]interface{}, key string) (string, bool) {
+	if _, ok := object[key]; ok {
+		return key, true
+	}
+
+	for k := range object {
+		if strings.EqualFold(k, key) {
+			return k, true
+		}
+	}
+
+	return "", false
+}
+
+var envReference = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// interpolateEnv replaces ${VAR} in every string with the environment
+// variable, or the default in ${VAR:-default} if it's unset or empty. $$
+// escapes a literal $.
+func interpolateEnv(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return envReference.ReplaceAllStringFunc(v, func(reference string) string {
+			if reference == "$$" {
+				return "$"
+			}
+
+			m := envReference.FindStringSubmatch(reference)
+			if value := os.Getenv(m[1]); value != "" {
+				return value
+			}
+			return m[2]
+		})
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = interpolateEnv(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = interpolateEnv(item)
+		}
+	}
+
+	return value
+}
+
+// applyEnvOverrides sets every RUSTCON_ environment variable in the config,
+// e.g. RUSTCON_INFLUX__PORT=8087 sets influx.port, and
+// RUSTCON_STATS__INVOKED__0__INTERVAL=5 the interval of the first invoked
+// stat. Values starting with [ or { are decoded as JSON.
+func applyEnvOverrides(tree map[string]interface{}, environ []string, configType reflect.Type) error {
+	sort.Strings(environ)
+
+	for _, env := range environ {
+		if !strings.HasPrefix(env, envPrefix) {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(env, envPrefix), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+
+		var value interface{} = parts[1]
+		if strings.HasPrefix(parts[1], "[") || strings.HasPrefix(parts[1], "{") {
+			if err := json.Unmarshal([]byte(parts[1]), &value); err != nil {
+				return fmt.Errorf("%s%s: %s", envPrefix, parts[0], err)
+			}
+		}
+
+		path := strings.Split(strings.ToLower(parts[0]), "__")
+		if _, err := setConfigPath(tree, path, value, configType); err != nil {
+			return fmt.Errorf("%s%s: %s", envPrefix, parts[0], err)
+		}
+	}
+
+	return nil
+}
+
+// setConfigPath sets the value at path below node, returning the node as
+// lists may grow. An index one past the end of a list appends to it.
+func setConfigPath(node interface{}, path []string, value interface{}, t reflect.Type) (interface{}, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch container := node.(type) {
+	case map[string]interface{}:
+		key, ok := lookupKey(container, path[0])
+		if !ok {
+			key = path[0]
+		}
+
+		var next reflect.Type
+		switch t.Kind() {
+		case reflect.Struct:
+			next, ok = lookupField(jsonFields(t), key)
+			if !ok {
+				return nil, fmt.Errorf("unknown key %s", path[0])
+			}
+		case reflect.Map:
+			next = t.Elem()
+		default:
+			return nil, fmt.Errorf("%s isn't an object", path[0])
+		}
+
+		if len(path) == 1 {
+			container[key] = value
+			return container, nil
+		}
+
+		child, ok := container[key]
+		if !ok || child == nil {
+			child = emptyConfigNode(next)
+		}
+
+		child, err := setConfigPath(child, path[1:], value, next)
+		if err != nil {
+			return nil, err
+		}
+		container[key] = child
+
+		return container, nil
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return nil, fmt.Errorf("%s isn't a list", path[0])
+		}
+
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i > len(container) {
+			return nil, fmt.Errorf("%s isn't an index of the list, or one past its end", path[0])
+		}
+
+		if i == len(container) {
+			container = append(container, emptyConfigNode(t.Elem()))
+		}
+
+		if len(path) == 1 {
+			container[i] = value
+			return container, nil
+		}
+
+		child, err := setConfigPath(container[i], path[1:], value, t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		container[i] = child
+
+		return container, nil
+	}
+
+	return nil, fmt.Errorf("%s can't be set on a plain value", path[0])
+}
+
+func emptyConfigNode(t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Slice:
+		return []interface{}{}
+	case reflect.Struct, reflect.Map:
+		return make(map[string]interface{})
+	}
+
+	return nil
+}
+
+// coerceConfig converts strings, e.g. from environment variables, to the
+// number or bool the setting expects.
+func coerceConfig(value interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return value
+	}
+
+	switch v := value.(type) {
+	case string:
+		switch t.Kind() {
+		case reflect.Bool:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return json.Number(strconv.FormatFloat(f, 'f', -1, 64))
+			}
+		}
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := jsonFields(t)
+			for k, item := range v {
+				if ft, ok := lookupField(fields, k); ok {
+					v[k] = coerceConfig(item, ft)
+				}
+			}
+		case reflect.Map:
+			for k, item := range v {
+				v[k] = coerceConfig(item, t.Elem())
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i, item := range v {
+				v[i] = coerceConfig(item, t.Elem())
+			}
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chzyer/readline"
+	"go.uber.org/zap"
+
+	"github.com/diametric/rustcon/webrcon"
+)
+
+// Exit codes of the console subcommand, for shell scripts using -c.
+const (
+	consoleOK         = 0
+	consoleError      = 1
+	consoleUsage      = 2
+	consoleNoResponse = 3
+)
+
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorYellow = "\033[33m"
+	colorCyan   = "\033[36m"
+	colorGrey   = "\033[90m"
+)
+
+const consoleHelp = `Commands are sent to the server as they're typed. Besides those:
+  .tail    toggle showing the live console and chat
+  .help    show this help
+  .exit    leave the console, as do exit and Ctrl-D
+`
+
+// rconConsole sends commands typed at a prompt, or given with -c, and prints
+// their responses along with the live console.
+type rconConsole struct {
+	rcon    *webrcon.RconClient
+	out     io.Writer
+	color   bool
+	timeout time.Duration
+	mu      sync.Mutex
+	tail    bool
+}
+
+// formatResponse pretty prints JSON responses, like playerlist and
+// serverinfo, and leaves anything else as it is.
+func formatResponse(message string) string {
+	trimmed := strings.TrimSpace(message)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, []byte(trimmed), "", "  "); err == nil {
+			return indented.String()
+		}
+	}
+
+	return strings.TrimRight(message, "\n")
+}
+
+func (c *rconConsole) colorize(color string, s string) string {
+	if !c.color || color == "" {
+		return s
+	}
+
+	return color + s + colorReset
+}
+
+func (c *rconConsole) printf(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(c.out, format, args...)
+}
+
+// onMessage prints the live console and chat while tailing. Command responses
+// are printed by whoever sent the command.
+func (c *rconConsole) onMessage(message []byte) {
+	c.mu.Lock()
+	tail := c.tail
+	c.mu.Unlock()
+
+	if !tail {
+		return
+	}
+
+	var r webrcon.Response
+	if err := json.Unmarshal(message, &r); err != nil || r.Identifier >= webrcon.StartingIdentifier {
+		return
+	}
+
+	line := strings.TrimRight(r.Message, "\n")
+	color := ""
+	switch r.Type {
+	case "Error":
+		color = colorRed
+	case "Warning":
+		color = colorYellow
+	case "Chat":
+		color = colorCyan
+		var chat webrcon.ChatMessage
+		if err := json.Unmarshal([]byte(r.Message), &chat); err == nil {
+			line = fmt.Sprintf("[chat] %s: %s", chat.Username, chat.Message)
+		}
+	}
+
+	if line == "" {
+		return
+	}
+
+	c.printf("%s\n", c.colorize(color, line))
+}
+
+// run sends a command and waits for its response.
+func (c *rconConsole) run(command string) (*webrcon.Response, error) {
+	if !c.rcon.Connected() {
+		return nil, errors.New("not connected to RCON, reconnecting")
+	}
+
+	// Whoever's at the prompt wants what the server says now, not what it said
+	// a few seconds ago.
+	responses := make(chan *webrcon.Response, 1)
+	c.rcon.SendRequest(webrcon.Request{Command: command, Bypass: true}, func(response *webrcon.Response) {
+		responses <- response
+	})
+
+	select {
+	case response := <-responses:
+		return response, nil
+	case <-time.After(c.timeout):
+		return nil, fmt.Errorf("no response to %s within %s", command, c.timeout)
+	}
+}
+
+// interactive runs the prompt until it's closed.
+func (c *rconConsole) interactive(rl *readline.Instance) {
+	for {
+		line, err := rl.Readline()
+		if err == readline.ErrInterrupt {
+			if line == "" {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		command := strings.TrimSpace(line)
+		switch command {
+		case "":
+			continue
+		case ".exit", "exit":
+			return
+		case ".help":
+			c.printf("%s", consoleHelp)
+			continue
+		case ".tail":
+			c.mu.Lock()
+			c.tail = !c.tail
+			tail := c.tail
+			c.mu.Unlock()
+			c.printf("%s\n", c.colorize(colorGrey, fmt.Sprintf("Tailing the console: %t", tail)))
+			continue
+		}
+
+		response, err := c.run(command)
+		if err != nil {
+			c.printf("%s\n", c.colorize(colorRed, err.Error()))
+			continue
+		}
+
+		c.printf("%s\n", formatResponse(response.Message))
+	}
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".rustcon_history")
+}
+
+// runConsole implements the console subcommand, an interactive RCON prompt
+// using the same config and passfile as the service. Returns the process exit
+// code.
+func runConsole(args []string) int {
+	flags := flag.NewFlagSet("console", flag.ExitOnError)
+	configFile := flags.String("config", "rustcon.conf", "Path to the configuration file, JSON, YAML or TOML")
+	host := flags.String("hostname", "localhost", "RCON hostname")
+	port := flags.Int("port", 28016, "RCON port")
+	passfile := flags.String("passfile", ".rconpass", "Path to a file containing the RCON password")
+	command := flags.String("c", "", "Run a single command, print its response and exit")
+	timeout := flags.Int("timeout", 10, "Seconds to wait for a command's response")
+	tail := flags.Bool("tail", true, "Show the live console and chat between commands")
+	history := flags.String("history", defaultHistoryFile(), "Path to the command history file, empty to disable")
+	noColor := flags.Bool("no-color", false, "Don't colour the console by message type")
+	debug := flags.Bool("debug", false, "Log to stderr at debug level")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s console [options]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "With -c, exits %d once the response is printed, %d if rustcon couldn't connect, and %d\nif there's no response within the timeout.\n\n",
+			consoleOK, consoleError, consoleNoResponse)
+		flags.PrintDefaults()
+	}
+
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 0 || *timeout <= 0 {
+		flags.Usage()
+		return consoleUsage
+	}
+
+	config, err := loadconfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		return consoleError
+	}
+
+	// The console does its own reporting, so only log when debugging.
+	logger := zap.NewNop()
+	if *debug {
+		loggerConfig := zap.NewDevelopmentConfig()
+		loggerConfig.OutputPaths = []string{"stderr"}
+		if logger, err = loggerConfig.Build(); err != nil {
+			panic(err)
+		}
+	}
+
+	undo := zap.ReplaceGlobals(logger)
+	defer undo()
+	defer zap.S().Sync()
+
+	password, err := loadrconpass(*passfile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to read rcon passfile:", err)
+		return consoleError
+	}
+
+	rcon := webrcon.RconClient{IgnoreEmptyRconMessages: config.IgnoreEmptyRconMessages}
+	rcon.InitClient(*host, *port, password)
+
+	console := &rconConsole{
+		rcon:    &rcon,
+		out:     os.Stdout,
+		color:   !*noColor && os.Getenv("NO_COLOR") == "" && readline.IsTerminal(int(os.Stdout.Fd())),
+		timeout: time.Duration(*timeout) * time.Second,
+		tail:    *tail && *command == "",
+	}
+	rcon.OnReceive(webrcon.OnMessageCallback{Callback: console.onMessage})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		rcon.Disconnect()
+	}()
+
+	if err := rcon.Connect(done, &wg); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to %s:%d: %s\n", *host, *port, err)
+		return consoleError
+	}
+
+	if *command != "" {
+		response, err := console.run(*command)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return consoleNoResponse
+		}
+
+		fmt.Println(formatResponse(response.Message))
+		return consoleOK
+	}
+
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:          fmt.Sprintf("%s:%d> ", *host, *port),
+		HistoryFile:     *history,
+		InterruptPrompt: "^C",
+		EOFPrompt:       "exit",
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to start the prompt:", err)
+		return consoleError
+	}
+	defer rl.Close()
+
+	// Print through readline, so the live console doesn't garble the prompt.
+	// The reader is already running, so swap the writer under the lock.
+	console.mu.Lock()
+	console.out = rl.Stdout()
+	console.mu.Unlock()
+	console.printf("Connected to %s:%d, type .help for help.\n", *host, *port)
+
+	// Reconnect if the server restarts while the console is open.
+	go rcon.MaintainConnection(done, &wg)
+
+	console.interactive(rl)
+
+	return consoleOK
+}
@@ -7,7 +7,8 @@ SERVER=$1
 
 echo "Starting up rustcon for $SERVER on $HOST:$PORT."
 
-/opt/rustcon/rustcon \
+# exec so rustcon is the service's main process, and can notify systemd.
+exec /opt/rustcon/rustcon \
 	-config /opt/rustcon/rustcon.conf \
 	-hostname $HOST \
 	-port $PORT \
@@ -3,6 +3,8 @@ module github.com/diametric/rustcon
 go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/chzyer/readline v1.5.1
 	github.com/d5/tengo v1.24.8
 	github.com/d5/tengo/v2 v2.10.1
 	github.com/davecgh/go-spew v1.1.1
@@ -17,6 +19,7 @@ require (
 	github.com/pkg/errors v0.9.1
 	go.uber.org/zap v1.21.0
 	golang.org/x/sys v0.0.0-20220405052023-b1e9470b6e64
+	gopkg.in/yaml.v2 v2.2.8
 )
 
 require (
@@ -31,5 +34,4 @@ require (
 	golang.org/x/crypto v0.0.0-20191112222119-e1110fd1c708 // indirect
 	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4 // indirect
 	golang.org/x/text v0.3.3 // indirect
-	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
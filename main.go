@@ -8,13 +8,17 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"regexp"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	"github.com/diametric/rustcon/middleware"
+	"github.com/diametric/rustcon/scheduler"
 	"github.com/diametric/rustcon/stats"
 	"github.com/diametric/rustcon/version"
 	"github.com/diametric/rustcon/webrcon"
@@ -31,33 +35,128 @@ type CommandLineConfig struct {
 	Version      *bool
 	Debug        *bool
 	Test         *bool
+	Record       *string
+	Strict       *bool
 }
 
 // Config file definition
 type Config struct {
-	EnableRedisQueue        bool                     `json:"enable_redis_queue"`
-	EnableInfluxStats       bool                     `json:"enable_influx_stats"`
-	QueuesPrefix            string                   `json:"queues_prefix"`
-	IntervalCallbacks       []IntervalCallbackConfig `json:"interval_callbacks"`
-	StaticQueues            []string                 `json:"static_queues"`
-	DynamicQueueKey         string                   `json:"dynamic_queue_key"`
-	CallbackQueueKey        string                   `json:"callback_queue_key"`
-	CallbackExpire          int                      `json:"callback_expire"`
-	LoggingConfig           zap.Config               `json:"logging"`
-	MaxQueueSize            int                      `json:"max_queue_size"`
-	CallOnMessageOnInvoke   bool                     `json:"call_onmessage_on_invoke"`
-	IgnoreEmptyRconMessages bool                     `json:"ignore_empty_rcon_messages"`
-	OnConnectDelay          int                      `json:"onconnect_delay"`
-	RedisConfig             RedisConfig              `json:"redis"`
-	InfluxConfig            InfluxConfig             `json:"influx"`
-	StatsConfig             StatsConfig              `json:"stats"`
+	EnableRedisQueue        bool                                 `json:"enable_redis_queue"`
+	EnableInfluxStats       bool                                 `json:"enable_influx_stats"`
+	QueuesPrefix            string                               `json:"queues_prefix"`
+	IntervalCallbacks       []IntervalCallbackConfig             `json:"interval_callbacks"`
+	StaticQueues            []string                             `json:"static_queues"`
+	DynamicQueueKey         string                               `json:"dynamic_queue_key"`
+	CallbackQueueKey        string                               `json:"callback_queue_key"`
+	CallbackExpire          int                                  `json:"callback_expire"`
+	LoggingConfig           zap.Config                           `json:"logging"`
+	MaxQueueSize            int                                  `json:"max_queue_size"`
+	CallOnMessageOnInvoke   bool                                 `json:"call_onmessage_on_invoke"`
+	IgnoreEmptyRconMessages bool                                 `json:"ignore_empty_rcon_messages"`
+	OnMessageBuffer         int                                  `json:"onmessage_buffer"`
+	OnMessageOverflow       string                               `json:"onmessage_overflow"`
+	OnConnectDelay          int                                  `json:"onconnect_delay"`
+	CacheConfig             map[string]CacheConfig               `json:"cache"`
+	RedisConfig             RedisConfig                          `json:"redis"`
+	InfluxConfig            InfluxConfig                         `json:"influx"`
+	StatsConfig             StatsConfig                          `json:"stats"`
+	GlobalsConfig           GlobalsConfig                        `json:"globals"`
+	NotificationsConfig     NotificationsConfig                  `json:"notifications"`
+	NotificationTargets     map[string]*stats.NotificationTarget `json:"notification_targets"`
+	AlertsConfig            AlertsConfig                         `json:"alerts"`
+	MessageAssembler        MessageAssemblerConfig               `json:"message_assembler"`
+	DefaultTags             map[string]string                    `json:"default_tags"`
+	SinksConfig             SinksConfig                          `json:"sinks"`
+	AdminConfig             AdminConfig                          `json:"admin"`
+}
+
+// AdminConfig settings for the health, readiness and introspection endpoints
+type AdminConfig struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen"`
+	Pprof   bool   `json:"pprof"`
+}
+
+// MessageAssemblerConfig settings for joining log entries split across
+// several RCON messages before they reach the monitored stats
+type MessageAssemblerConfig struct {
+	Enabled      bool     `json:"enabled"`
+	Headers      []string `json:"headers"`
+	Continuation string   `json:"continuation"`
+	WindowMs     int      `json:"window_ms"`
+	MaxLines     int      `json:"max_lines"`
+}
+
+// SinksConfig settings for the measurement outputs besides InfluxDB
+type SinksConfig struct {
+	Prometheus  PrometheusSinkConfig  `json:"prometheus"`
+	File        FileSinkConfig        `json:"file"`
+	RedisStream RedisStreamSinkConfig `json:"redis_stream"`
+}
+
+// PrometheusSinkConfig settings for serving measurements to Prometheus
+type PrometheusSinkConfig struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen"`
+	Expire  int    `json:"expire"`
+}
+
+// FileSinkConfig settings for writing measurements, and optionally every raw
+// RCON message, to local files
+type FileSinkConfig struct {
+	Enabled  bool           `json:"enabled"`
+	Path     string         `json:"path"`
+	Format   string         `json:"format"`
+	RconLog  string         `json:"rcon_log"`
+	Rotation RotationConfig `json:"rotation"`
+}
+
+// RotationConfig settings for rotating local files. Sizes are in megabytes,
+// times in seconds.
+type RotationConfig struct {
+	MaxSize  int  `json:"max_size"`
+	Interval int  `json:"interval"`
+	Compress bool `json:"compress"`
+	MaxFiles int  `json:"max_files"`
+	MaxAge   int  `json:"max_age"`
+}
+
+// RedisStreamSinkConfig settings for adding measurements to a redis stream
+type RedisStreamSinkConfig struct {
+	Enabled bool   `json:"enabled"`
+	Key     string `json:"key"`
+	MaxLen  int    `json:"maxlen"`
+}
+
+// AlertsConfig settings for declarative alert rules
+type AlertsConfig struct {
+	StateKey string                  `json:"state_key"`
+	Rules    []stats.AlertRuleConfig `json:"rules"`
+	Silences []stats.AlertSilence    `json:"silences"`
+}
+
+// NotificationsConfig settings for the asynchronous alert dispatcher
+type NotificationsConfig struct {
+	Cooldown     int `json:"cooldown"`
+	MaxPerMinute int `json:"max_per_minute"`
+	MaxRetries   int `json:"max_retries"`
+	QueueSize    int `json:"queue_size"`
+}
+
+// GlobalsConfig settings for persisting _GLOBALS between restarts
+type GlobalsConfig struct {
+	Backend       string `json:"backend"`
+	Path          string `json:"path"`
+	RedisKey      string `json:"redis_key"`
+	FlushInterval int    `json:"flush_interval"`
 }
 
 // StatsConfig definition
 type StatsConfig struct {
-	Internal  []InternalStatsConfig
-	Invoked   []InvokedStatConfig
-	Monitored []MonitoredStatConfig
+	Internal     []InternalStatsConfig     `json:"internal"`
+	Invoked      []InvokedStatConfig       `json:"invoked"`
+	Monitored    []MonitoredStatConfig     `json:"monitored"`
+	Aggregations []stats.AggregationConfig `json:"aggregations"`
 }
 
 // ScriptedStatImpl defines the base implementation all stat configs use
@@ -66,31 +165,62 @@ type ScriptedStatImpl struct {
 	Disabled bool   `json:"disabled"`
 }
 
+// ScheduleConfig spreads out jobs sharing an interval, delaying every run by
+// offset and a random amount up to jitter.
+type ScheduleConfig struct {
+	Offset scheduler.Duration `json:"offset"`
+	Jitter scheduler.Duration `json:"jitter"`
+}
+
 // InternalStatsConfig definition
 type InternalStatsConfig struct {
 	ScriptedStatImpl
-	Interal int `json:"interval"`
+	ScheduleConfig
+	Interval scheduler.Duration `json:"interval"`
 }
 
 // InvokedStatConfig definition
 type InvokedStatConfig struct {
 	ScriptedStatImpl
-	Command  string `json:"command"`
-	Interval int    `json:"interval"`
+	ScheduleConfig
+	Command  string             `json:"command"`
+	Interval scheduler.Duration `json:"interval"`
 }
 
 // MonitoredStatConfig definition
 type MonitoredStatConfig struct {
 	ScriptedStatImpl
-	Pattern string `json:"pattern"`
+	Pattern   string   `json:"pattern"`
+	Types     []string `json:"types"`
+	Contains  string   `json:"contains"`
+	DotAll    bool     `json:"dot_all"`
+	Multiline bool     `json:"multiline"`
+	// For script-less monitored stats, built from the pattern's named groups.
+	Measurement string            `json:"measurement"`
+	Bucket      string            `json:"bucket"`
+	Tags        []string          `json:"tags"`
+	Fields      map[string]string `json:"fields"`
 }
 
 // IntervalCallbackConfig definition
 type IntervalCallbackConfig struct {
-	Command      string `json:"command"`
-	StorageKey   string `json:"storage_key"`
-	Interval     int    `json:"interval"`
-	RunOnConnect bool   `json:"run_on_connect"`
+	ScheduleConfig
+	Command      string             `json:"command"`
+	StorageKey   string             `json:"storage_key"`
+	Interval     scheduler.Duration `json:"interval"`
+	RunOnConnect bool               `json:"run_on_connect"`
+	Parse        bool               `json:"parse"`
+	Storage      string             `json:"storage"`
+	TTL          scheduler.Duration `json:"ttl"`
+	MaxLength    int                `json:"max_length"`
+	Transform    string             `json:"transform"`
+}
+
+// CacheConfig settings for caching the responses to a command, overriding the
+// interval callbacks and invoked stats using it
+type CacheConfig struct {
+	TTL                  scheduler.Duration `json:"ttl"`
+	StaleWhileRevalidate scheduler.Duration `json:"stale_while_revalidate"`
 }
 
 // RedisConfig settings to connect to Redis
@@ -132,52 +262,51 @@ func saneOpen(f string) (*os.File, error) {
 	return file, nil
 }
 
-func loadconfig(filename string) (*Config, error) {
-	file, err := saneOpen(filename)
+func loadrconpass(passfile string) (string, error) {
+	data, err := ioutil.ReadFile(passfile)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	config := Config{}
+	return strings.TrimSpace(string(data)), nil
+}
 
-	err = decoder.Decode(&config)
+func buildStorage(cb IntervalCallbackConfig) (*middleware.Storage, error) {
+	mode, err := middleware.ParseStorageMode(cb.Storage)
 	if err != nil {
-		return nil, fmt.Errorf("JSON parse error: %s", err)
+		return nil, err
 	}
 
-	return &config, nil
-}
+	storage := &middleware.Storage{
+		Key:       cb.StorageKey,
+		Mode:      mode,
+		TTL:       cb.TTL.Duration(),
+		MaxLength: cb.MaxLength,
+		Parse:     cb.Parse,
+	}
 
-func loadrconpass(passfile string) (string, error) {
-	data, err := ioutil.ReadFile(passfile)
-	if err != nil {
-		return "", err
+	if cb.Transform != "" {
+		if storage.Transform, err = middleware.NewTransform(cb.Transform); err != nil {
+			return nil, fmt.Errorf("unable to load transform %s: %s", cb.Transform, err)
+		}
 	}
 
-	return strings.TrimSpace(string(data)), nil
+	return storage, nil
 }
 
 // I don't like this. Need to rework this at some point.
-func buildOnConnectCallback(tag string, middleware middleware.Processor, cb IntervalCallbackConfig) webrcon.OnConnectCallback {
+func buildOnConnectCallback(middleware middleware.Processor, cb IntervalCallbackConfig, storage *middleware.Storage) webrcon.OnConnectCallback {
 	return webrcon.OnConnectCallback{
 		Command: cb.Command,
 		Callback: func(response *webrcon.Response) {
-			_, err := middleware.Do("SET", strings.ReplaceAll(
-				cb.StorageKey,
-				"{tag}",
-				tag), response.Message)
-			if err != nil {
-				zap.S().Errorf("Error writing to redis in callback: %s", err)
-			}
+			middleware.StoreResponse(cb.Command, storage, response)
 		},
 	}
 }
 
 func buildDynamicQueueCallback(queuekey string, queueprefix string, tag string, queuemax int, middleware middleware.Processor) webrcon.OnMessageCallback {
 	return webrcon.OnMessageCallback{
+		Name: "dynamic-queues",
 		Callback: func(message []byte) {
 			queues, err := redis.Strings(middleware.Do("SMEMBERS", queuekey))
 			if err != nil {
@@ -204,6 +333,7 @@ func buildDynamicQueueCallback(queuekey string, queueprefix string, tag string,
 
 func buildQueueCallback(queue string, queuemax int, middleware middleware.Processor) webrcon.OnMessageCallback {
 	return webrcon.OnMessageCallback{
+		Name: "queue:" + queue,
 		Callback: func(message []byte) {
 			conn, err := middleware.StartPipeline()
 			if err != nil {
@@ -219,10 +349,384 @@ func buildQueueCallback(queue string, queuemax int, middleware middleware.Proces
 	}
 }
 
+// pathUnsafe are the characters that can't be used in a file name on Windows,
+// such as the : in a host:port tag.
+var pathUnsafe = strings.NewReplacer("<", "_", ">", "_", ":", "_", "\"", "_", "/", "_", "\\", "_", "|", "_", "?", "_", "*", "_")
+
+// tagPath replaces {tag} in a file path with the tag, made safe to use in a
+// file name.
+func tagPath(path string, tag string) string {
+	return strings.ReplaceAll(path, "{tag}", pathUnsafe.Replace(tag))
+}
+
+func buildGlobalsBackend(tag string, config *Config) (stats.GlobalsBackend, error) {
+	switch config.GlobalsConfig.Backend {
+	case "":
+		return nil, nil
+	case "file":
+		path := config.GlobalsConfig.Path
+		if path == "" {
+			path = "rustcon-globals.json"
+		}
+		return &stats.FileGlobalsBackend{Path: tagPath(path, tag)}, nil
+	case "redis":
+		key := config.GlobalsConfig.RedisKey
+		if key == "" {
+			key = "rustcon:{tag}:globals"
+		}
+		return &stats.RedisGlobalsBackend{
+			Pool: middleware.NewPool(
+				config.RedisConfig.Host,
+				config.RedisConfig.Port,
+				config.RedisConfig.Database,
+				config.RedisConfig.Password),
+			Key: strings.ReplaceAll(key, "{tag}", tag),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown globals backend %s, must be one of file or redis", config.GlobalsConfig.Backend)
+}
+
+func buildSinks(tag string, config *Config) []stats.Sink {
+	var sinks []stats.Sink
+
+	if config.SinksConfig.Prometheus.Enabled {
+		listen := config.SinksConfig.Prometheus.Listen
+		if listen == "" {
+			listen = ":9273"
+		}
+		expire := config.SinksConfig.Prometheus.Expire
+		if expire == 0 {
+			expire = 300
+		}
+		sinks = append(sinks, &stats.PrometheusSink{Listen: listen, Expire: expire})
+	}
+
+	if config.SinksConfig.File.Enabled {
+		path := config.SinksConfig.File.Path
+		if path == "" {
+			path = "measurements-{tag}.jsonl"
+			if config.SinksConfig.File.Format == "csv" {
+				path = "measurements-{tag}.csv"
+			}
+		}
+
+		file := buildRotatingFile(tagPath(path, tag), config.SinksConfig.File.Rotation)
+		if config.SinksConfig.File.Format == "csv" {
+			file.Header = []byte(stats.CSVHeader)
+		}
+
+		sinks = append(sinks, &stats.FileSink{
+			Tag:    tag,
+			Format: config.SinksConfig.File.Format,
+			File:   file,
+		})
+	}
+
+	if config.SinksConfig.RedisStream.Enabled {
+		key := config.SinksConfig.RedisStream.Key
+		if key == "" {
+			key = "rustcon:{tag}:measurements"
+		}
+		maxlen := config.SinksConfig.RedisStream.MaxLen
+		if maxlen == 0 {
+			maxlen = 10000
+		}
+		sinks = append(sinks, &stats.RedisStreamSink{
+			Pool: middleware.NewPool(
+				config.RedisConfig.Host,
+				config.RedisConfig.Port,
+				config.RedisConfig.Database,
+				config.RedisConfig.Password),
+			Key:    strings.ReplaceAll(key, "{tag}", tag),
+			MaxLen: maxlen,
+		})
+	}
+
+	return sinks
+}
+
+func buildRotatingFile(path string, rotation RotationConfig) *stats.RotatingFile {
+	return &stats.RotatingFile{
+		Path:     path,
+		MaxSize:  int64(rotation.MaxSize) * 1024 * 1024,
+		Interval: time.Duration(rotation.Interval) * time.Second,
+		Compress: rotation.Compress,
+		MaxFiles: rotation.MaxFiles,
+		MaxAge:   time.Duration(rotation.MaxAge) * time.Second,
+	}
+}
+
+// buildRconLog returns the raw RCON message log, if the file sink has one
+// configured.
+func buildRconLog(tag string, config *Config) *stats.MessageLog {
+	if !config.SinksConfig.File.Enabled || config.SinksConfig.File.RconLog == "" {
+		return nil
+	}
+
+	return &stats.MessageLog{
+		Tag: tag,
+		File: buildRotatingFile(
+			tagPath(config.SinksConfig.File.RconLog, tag),
+			config.SinksConfig.File.Rotation),
+	}
+}
+
+// buildDefaultTags returns the tags added to every measurement that doesn't
+// already set them. Without a default_tags section, servertag is set to the tag.
+func buildDefaultTags(tag string, config *Config) map[string]string {
+	if config.DefaultTags == nil {
+		return map[string]string{"servertag": tag}
+	}
+
+	tags := make(map[string]string)
+	for k, v := range config.DefaultTags {
+		tags[k] = strings.ReplaceAll(v, "{tag}", tag)
+	}
+
+	return tags
+}
+
+func buildAlertManager(tag string, config *Config, dispatcher *stats.Dispatcher) *stats.AlertManager {
+	alerts := &stats.AlertManager{
+		Tag:        tag,
+		Dispatcher: dispatcher,
+		Silences:   config.AlertsConfig.Silences}
+
+	for _, rule := range config.AlertsConfig.Rules {
+		for _, target := range rule.Targets {
+			if _, ok := config.NotificationTargets[target]; !ok {
+				zap.S().Warnf("Alert rule %s uses unknown notification target %s", rule.Name, target)
+			}
+		}
+
+		if err := alerts.AddRule(rule); err != nil {
+			zap.S().Errorf("Unable to add alert rule %s: %s", rule.Name, err)
+		}
+	}
+
+	if config.EnableRedisQueue && config.AlertsConfig.StateKey != "" {
+		pool := middleware.NewPool(
+			config.RedisConfig.Host,
+			config.RedisConfig.Port,
+			config.RedisConfig.Database,
+			config.RedisConfig.Password)
+		key := strings.ReplaceAll(config.AlertsConfig.StateKey, "{tag}", tag)
+
+		alerts.Publish = func(states []stats.AlertState) {
+			data, err := json.Marshal(states)
+			if err != nil {
+				zap.S().Errorf("Error encoding alert states: %s", err)
+				return
+			}
+
+			conn := pool.Get()
+			defer conn.Close()
+
+			if _, err := conn.Do("SET", key, data); err != nil {
+				zap.S().Errorf("Error writing alert states to redis: %s", err)
+			}
+		}
+	}
+
+	return alerts
+}
+
+func buildLogger(config *Config, debug bool) (*zap.Logger, error) {
+	// Defaults for configs without a logging section, e.g. from the
+	// environment alone.
+	if config.LoggingConfig.Level == (zap.AtomicLevel{}) {
+		config.LoggingConfig.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+	}
+	if config.LoggingConfig.Encoding == "" {
+		config.LoggingConfig.Encoding = "console"
+	}
+	if len(config.LoggingConfig.OutputPaths) == 0 {
+		config.LoggingConfig.OutputPaths = []string{"stdout"}
+	}
+	if len(config.LoggingConfig.ErrorOutputPaths) == 0 {
+		config.LoggingConfig.ErrorOutputPaths = []string{"stderr"}
+	}
+
+	config.LoggingConfig.EncoderConfig = zapcore.EncoderConfig{
+		MessageKey:   "message",
+		LevelKey:     "level",
+		EncodeLevel:  zapcore.CapitalColorLevelEncoder,
+		TimeKey:      "time",
+		EncodeTime:   zapcore.ISO8601TimeEncoder,
+		CallerKey:    "caller",
+		EncodeCaller: zapcore.ShortCallerEncoder,
+	}
+
+	if debug {
+		fmt.Println("Overriding configured log level, setting to debug.")
+		config.LoggingConfig.Level.SetLevel(zap.DebugLevel)
+	}
+
+	return config.LoggingConfig.Build()
+}
+
+// buildCachePolicies converts the cache config into the RCON client's cache
+// policies, by command.
+func buildCachePolicies(config *Config) map[string]webrcon.CachePolicy {
+	policies := make(map[string]webrcon.CachePolicy, len(config.CacheConfig))
+	for command, cache := range config.CacheConfig {
+		policies[command] = webrcon.CachePolicy{
+			TTL:                  cache.TTL.Duration(),
+			StaleWhileRevalidate: cache.StaleWhileRevalidate.Duration(),
+		}
+	}
+
+	return policies
+}
+
+// buildAssembler returns the message assembler feeding output, or nil if it's
+// disabled or misconfigured.
+func buildAssembler(config *Config, output func(message []byte)) *stats.Assembler {
+	if !config.MessageAssembler.Enabled {
+		return nil
+	}
+
+	assembler := &stats.Assembler{
+		Window:         time.Duration(config.MessageAssembler.WindowMs) * time.Millisecond,
+		MaxLines:       config.MessageAssembler.MaxLines,
+		IncludeInvoked: config.CallOnMessageOnInvoke,
+		Output:         output}
+
+	if assembler.Window <= 0 {
+		assembler.Window = 250 * time.Millisecond
+	}
+
+	for _, header := range config.MessageAssembler.Headers {
+		re, err := regexp.Compile(header)
+		if err != nil {
+			zap.S().Errorf("Message assembler disabled, unable to compile header %s: %s", header, err)
+			return nil
+		}
+		assembler.Headers = append(assembler.Headers, re)
+	}
+
+	if config.MessageAssembler.Continuation != "" {
+		re, err := regexp.Compile(config.MessageAssembler.Continuation)
+		if err != nil {
+			zap.S().Errorf("Message assembler disabled, unable to compile continuation %s: %s",
+				config.MessageAssembler.Continuation, err)
+			return nil
+		}
+		assembler.Continuation = re
+	}
+
+	return assembler
+}
+
+// buildStatsClient sets up the stats client, its alerting and sinks, and
+// registers every configured stat. Collection is left to the caller to start.
+func buildStatsClient(tag string, config *Config, rcon *webrcon.RconClient, sinks []stats.Sink, test bool, done chan struct{}, wg *sync.WaitGroup) *stats.Client {
+	dispatcher := stats.Dispatcher{
+		Tag:          tag,
+		Test:         test,
+		Cooldown:     config.NotificationsConfig.Cooldown,
+		MaxPerMinute: config.NotificationsConfig.MaxPerMinute,
+		MaxRetries:   config.NotificationsConfig.MaxRetries,
+		QueueSize:    config.NotificationsConfig.QueueSize,
+		Targets:      config.NotificationTargets}
+	dispatcher.InitDispatcher()
+	go dispatcher.Run(done, wg)
+
+	statsclient := stats.Client{
+		Tag:         tag,
+		Rcon:        rcon,
+		Test:        test,
+		Dispatcher:  &dispatcher,
+		DefaultTags: buildDefaultTags(tag, config)}
+
+	if len(config.AlertsConfig.Rules) > 0 {
+		statsclient.Alerts = buildAlertManager(tag, config, &dispatcher)
+	}
+	if len(config.StatsConfig.Aggregations) > 0 {
+		statsclient.Aggregator = &stats.Aggregator{Write: statsclient.WriteSummaries}
+		for _, aggregation := range config.StatsConfig.Aggregations {
+			if err := statsclient.Aggregator.Add(aggregation); err != nil {
+				zap.S().Errorf("Unable to add aggregation of %s: %s", aggregation.Measurement, err)
+			}
+		}
+		go statsclient.Aggregator.Run(done, wg)
+	}
+	if config.EnableInfluxStats {
+		statsclient.InitClient(
+			config.InfluxConfig.Host,
+			config.InfluxConfig.Port,
+			config.InfluxConfig.Database,
+			config.InfluxConfig.Username,
+			config.InfluxConfig.Password,
+			config.InfluxConfig.SSL)
+	}
+
+	for _, sink := range sinks {
+		switch sink := sink.(type) {
+		case *stats.PrometheusSink:
+			if !test {
+				go sink.Serve(done, wg)
+			}
+		}
+		statsclient.AddSink(sink)
+	}
+
+	for _, v := range config.StatsConfig.Invoked {
+		if !v.Disabled {
+			statsclient.RegisterInvokedStat(v.Command, v.Script,
+				v.Interval.Duration(), v.Offset.Duration(), v.Jitter.Duration())
+		}
+	}
+
+	for _, v := range config.StatsConfig.Internal {
+		if !v.Disabled {
+			statsclient.RegisterInternalStat(v.Script,
+				v.Interval.Duration(), v.Offset.Duration(), v.Jitter.Duration())
+		}
+	}
+
+	for _, v := range config.StatsConfig.Monitored {
+		if !v.Disabled {
+			statsclient.RegisterMonitoredStat(v.Pattern, v.Script, stats.MonitoredStatOptions{
+				Types:       v.Types,
+				Contains:    v.Contains,
+				DotAll:      v.DotAll,
+				Multiline:   v.Multiline,
+				Measurement: v.Measurement,
+				Bucket:      v.Bucket,
+				Tags:        v.Tags,
+				Fields:      v.Fields,
+			})
+		}
+	}
+
+	callback := statsclient.OnMessageMonitoredStat
+	if assembler := buildAssembler(config, callback); assembler != nil {
+		callback = assembler.OnMessage
+	}
+	rcon.OnMessage(webrcon.OnMessageCallback{
+		Name:     "monitored-stats",
+		Callback: callback})
+
+	return &statsclient
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "validate":
+			os.Exit(runValidate(os.Args[2:]))
+		case "console":
+			os.Exit(runConsole(os.Args[2:]))
+		}
+	}
+
 	opts := CommandLineConfig{}
 
-	opts.ConfigFile = flag.String("config", "rustcon.conf", "Path to the configuration file")
+	opts.ConfigFile = flag.String("config", "rustcon.conf", "Path to the configuration file, JSON, YAML or TOML")
 	opts.RconHost = flag.String("hostname", "localhost", "RCON hostname")
 	opts.RconPort = flag.Int("port", 28016, "RCON port")
 	opts.RconPassfile = flag.String("passfile", ".rconpass", "Path to a file containing the RCON password")
@@ -230,6 +734,8 @@ func main() {
 	opts.Version = flag.Bool("version", false, "Display version information")
 	opts.Debug = flag.Bool("debug", false, "Override log level in config, and set to debug")
 	opts.Test = flag.Bool("test", false, "Perform only test writes, output to stdout")
+	opts.Record = flag.String("record", "", "Record every RCON frame sent and received to this file, for use with replay")
+	opts.Strict = flag.Bool("strict", false, "Validate the config and every script before starting, and refuse to start on any error")
 
 	flag.Parse()
 
@@ -243,33 +749,26 @@ func main() {
 		*opts.Tag = fmt.Sprintf("%s:%d", *opts.RconHost, *opts.RconPort)
 	}
 
-	config, err := loadconfig(*opts.ConfigFile)
+	config, raw, err := readconfig(*opts.ConfigFile)
 	if err != nil {
 		fmt.Println("Error loading config:", err)
 		return
 	}
 
-	if !config.EnableRedisQueue && !config.EnableInfluxStats {
-		fmt.Println("You must have at least one of enable_redis_queue or enable_influx_stats enabled.")
-		return
+	if *opts.Strict && reportProblems(*opts.ConfigFile, validateConfig(config, raw)) > 0 {
+		fmt.Println("Refusing to start with an invalid config in strict mode.")
+		os.Exit(1)
 	}
 
-	config.LoggingConfig.EncoderConfig = zapcore.EncoderConfig{
-		MessageKey:   "message",
-		LevelKey:     "level",
-		EncodeLevel:  zapcore.CapitalColorLevelEncoder,
-		TimeKey:      "time",
-		EncodeTime:   zapcore.ISO8601TimeEncoder,
-		CallerKey:    "caller",
-		EncodeCaller: zapcore.ShortCallerEncoder,
-	}
+	sinks := buildSinks(*opts.Tag, config)
+	rconLog := buildRconLog(*opts.Tag, config)
 
-	if *opts.Debug {
-		fmt.Println("Overriding configured log level, setting to debug.")
-		config.LoggingConfig.Level.SetLevel(zap.DebugLevel)
+	if !config.EnableRedisQueue && !config.EnableInfluxStats && len(sinks) == 0 && rconLog == nil {
+		fmt.Println("You must have at least one of enable_redis_queue, enable_influx_stats or a sink enabled.")
+		return
 	}
 
-	logger, logerr := config.LoggingConfig.Build()
+	logger, logerr := buildLogger(config, *opts.Debug)
 	if logerr != nil {
 		panic(logerr)
 	}
@@ -284,19 +783,39 @@ func main() {
 		return
 	}
 
+	overflow, err := webrcon.ParseOverflowPolicy(config.OnMessageOverflow)
+	if err != nil {
+		fmt.Println("Error in onmessage_overflow:", err)
+		return
+	}
+
 	rcon := webrcon.RconClient{
 		IgnoreEmptyRconMessages: config.IgnoreEmptyRconMessages,
 		CallOnMessageOnInvoke:   config.CallOnMessageOnInvoke,
-		OnConnectDelay:          config.OnConnectDelay}
+		OnConnectDelay:          config.OnConnectDelay,
+		MessageBuffer:           config.OnMessageBuffer,
+		Overflow:                overflow,
+		CachePolicies:           buildCachePolicies(config)}
 
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
 	done := make(chan struct{})
 	var wg sync.WaitGroup
 
 	rcon.InitClient(*opts.RconHost, *opts.RconPort, rconPassword)
 
+	if *opts.Record != "" {
+		recorder, err := webrcon.NewRecorder(*opts.Record)
+		if err != nil {
+			zap.S().Error("Unable to start recording: ", err)
+			return
+		}
+		rcon.Recorder = recorder
+		go recorder.CloseOnDone(done, &wg)
+	}
+
+	var schedulers []*scheduler.Scheduler
 	if config.EnableRedisQueue {
 		middleware := middleware.Processor{
 			Tag:              *opts.Tag,
@@ -316,15 +835,25 @@ func main() {
 		}
 
 		for _, v := range config.IntervalCallbacks {
+			storage, err := buildStorage(v)
+			if err != nil {
+				zap.S().Errorf("Unable to add %s callback: %s", v.Command, err)
+				continue
+			}
+
 			if v.Interval > 0 {
-				middleware.AddIntervalCallback(v.Command, v.Interval, v.StorageKey)
+				err := middleware.AddIntervalCallback(v.Command,
+					v.Interval.Duration(), v.Offset.Duration(), v.Jitter.Duration(), storage)
+				if err != nil {
+					zap.S().Errorf("Unable to add interval callback: %s", err)
+				}
 			} else {
 				if !v.RunOnConnect {
 					zap.S().Warnf("%s callback has 0 interval, and false run_on_connect. This callback will never run and is probably not what you intended.", v.Command)
 				}
 			}
 			if v.RunOnConnect {
-				rcon.OnConnect(buildOnConnectCallback(*opts.Tag, middleware, v))
+				rcon.OnConnect(buildOnConnectCallback(middleware, v, storage))
 			}
 		}
 
@@ -338,53 +867,57 @@ func main() {
 		// This is gross but whatever.
 		rcon.OnMessage(buildDynamicQueueCallback(config.DynamicQueueKey, config.QueuesPrefix, *opts.Tag, config.MaxQueueSize, middleware))
 
+		schedulers = append(schedulers, middleware.Scheduler())
 		go middleware.Process(done, &wg)
 	}
 
-	if config.EnableInfluxStats {
-		statsclient := stats.Client{Tag: *opts.Tag, Rcon: &rcon, Test: *opts.Test}
-		statsclient.InitClient(
-			config.InfluxConfig.Host,
-			config.InfluxConfig.Port,
-			config.InfluxConfig.Database,
-			config.InfluxConfig.Username,
-			config.InfluxConfig.Password,
-			config.InfluxConfig.SSL)
+	if rconLog != nil {
+		rcon.OnReceive(webrcon.OnMessageCallback{Callback: rconLog.OnMessage})
+		go rconLog.File.CloseOnDone(done, &wg)
+	}
 
-		for _, v := range config.StatsConfig.Invoked {
-			if !v.Disabled {
-				statsclient.RegisterInvokedStat(v.Command, v.Script, v.Interval)
-			}
-		}
+	// Stats run with InfluxDB, any other sink, or both.
+	var statsclient *stats.Client
+	if config.EnableInfluxStats || len(sinks) > 0 {
+		statsclient = buildStatsClient(*opts.Tag, config, &rcon, sinks, *opts.Test, done, &wg)
+		statsclient.Schedulers = schedulers
 
-		for _, v := range config.StatsConfig.Internal {
-			if !v.Disabled {
-				statsclient.RegisterInternalStat(v.Script, v.Interal)
+		globalsBackend, err := buildGlobalsBackend(*opts.Tag, config)
+		if err != nil {
+			zap.S().Error("Globals persistence disabled: ", err)
+		} else if globalsBackend != nil {
+			if err := stats.LoadGlobals(globalsBackend); err != nil {
+				zap.S().Error("Error loading persisted globals: ", err)
 			}
+			go stats.MaintainGlobals(globalsBackend, config.GlobalsConfig.FlushInterval, done, &wg)
 		}
 
-		for _, v := range config.StatsConfig.Monitored {
-			if !v.Disabled {
-				statsclient.RegisterMonitoredStat(v.Pattern, v.Script)
-			}
-		}
+		go statsclient.CollectStats(done, &wg)
+	}
 
-		rcon.OnMessage(webrcon.OnMessageCallback{
-			Callback: statsclient.OnMessageMonitoredStat})
+	if statsclient != nil {
+		schedulers = append([]*scheduler.Scheduler{statsclient.Scheduler()}, schedulers...)
+	}
 
-		go statsclient.CollectStats(done, &wg)
+	probe := buildReadinessProbe(config, &rcon, statsclient, *opts.Test)
+	if admin := buildAdminServer(*opts.Tag, config, probe, schedulers); admin != nil {
+		go admin.Serve(done, &wg)
 	}
+	go runNotifier(probe, schedulers, done, &wg)
 
 	go rcon.MaintainConnection(done, &wg)
 
 	for {
 		select {
-		case <-interrupt:
-			zap.S().Warn("CTRL-C caught, exiting.")
-			log.Println("CTRL-C caught, exiting.")
+		case sig := <-interrupt:
+			zap.S().Warnf("%s caught, exiting.", sig)
+			log.Printf("%s caught, exiting.", sig)
 			zap.S().Sync()
 			close(done)
 			wg.Wait()
+			if statsclient != nil {
+				statsclient.CloseSinks()
+			}
 			return
 		}
 	}
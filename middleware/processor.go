@@ -3,10 +3,10 @@ package middleware
 import (
 	"encoding/json"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/diametric/rustcon/scheduler"
 	"github.com/diametric/rustcon/webrcon"
 	"github.com/gomodule/redigo/redis"
 	"go.uber.org/zap"
@@ -19,25 +19,29 @@ type Processor struct {
 	CallbackQueueKey string
 	CallbackExpire   int
 	pool             *redis.Pool
-	tickcallbacks    []TickCallback
+	scheduler        *scheduler.Scheduler
 }
 
-// TickCallback processes the callbacks that run per tick.
+// TickCallback processes the callbacks that run at an interval.
 type TickCallback struct {
-	command    string
-	interval   int
-	storagekey string
+	command  string
+	interval time.Duration
+	storage  *Storage
 }
 
 // CallbackRequest contains the information to handle an RCON callback request.
+// BypassCache always sends the command, instead of answering it with a cached
+// response.
 type CallbackRequest struct {
-	ID      int    `json:"id"`
-	Command string `json:"command"`
+	ID          int    `json:"id"`
+	Command     string `json:"command"`
+	BypassCache bool   `json:"bypass_cache"`
 }
 
-// InitProcessor initializes the middleware processor, and establishes the redis connection pool
-func (processor *Processor) InitProcessor(host string, port int, database int, password string) {
-	processor.pool = &redis.Pool{
+// NewPool creates a redis connection pool. It's shared by anything else that
+// needs to talk to redis outside of the middleware processor.
+func NewPool(host string, port int, database int, password string) *redis.Pool {
+	return &redis.Pool{
 		Dial: func() (redis.Conn, error) {
 			c, err := redis.Dial(
 				"tcp",
@@ -59,13 +63,33 @@ func (processor *Processor) InitProcessor(host string, port int, database int, p
 	}
 }
 
-// AddIntervalCallback registers a callback func to be called at a specified tick interval
-func (processor *Processor) AddIntervalCallback(c string, i int, s string) {
-	processor.tickcallbacks = append(processor.tickcallbacks, TickCallback{
-		command:    c,
-		interval:   i,
-		storagekey: s,
-	})
+// InitProcessor initializes the middleware processor, and establishes the redis connection pool
+func (processor *Processor) InitProcessor(host string, port int, database int, password string) {
+	processor.pool = NewPool(host, port, database, password)
+	processor.scheduler = &scheduler.Scheduler{Name: "middleware"}
+}
+
+// AddIntervalCallback registers a callback func to be called at a specified
+// interval, delayed by offset and up to jitter, storing the response in s.
+func (processor *Processor) AddIntervalCallback(c string, i time.Duration, offset time.Duration, jitter time.Duration, s *Storage) error {
+	callback := TickCallback{
+		command:  c,
+		interval: i,
+		storage:  s,
+	}
+
+	return processor.scheduler.Add(scheduler.Job{
+		Name:     "callback:" + c,
+		Interval: i,
+		Offset:   offset,
+		Jitter:   jitter,
+		Run:      func() { processor.runTickCallback(callback) }})
+}
+
+// Scheduler returns the scheduler running the interval callbacks, for its job
+// stats.
+func (processor *Processor) Scheduler() *scheduler.Scheduler {
+	return processor.scheduler
 }
 
 // StartPipeline begins a redis pipeline. The caller is responsible for
@@ -99,15 +123,14 @@ func (processor *Processor) Do(command string, args ...interface{}) (interface{}
 
 // We need this to pass by reference the callback or everything breaks.
 func (processor *Processor) runTickCallback(callback TickCallback) {
-	zap.S().Debugf("PROCESSOR: Time to run %s, interval %d\n", callback.command, callback.interval)
-	processor.Rcon.SendCallback(callback.command, callback.interval-1, func(response *webrcon.Response) {
-		_, err := processor.Do("SET", strings.ReplaceAll(
-			callback.storagekey,
-			"{tag}",
-			processor.Tag), response.Message)
-		if err != nil {
-			zap.S().Errorf("Error writing to redis in callback: %s\n", err)
-		}
+	zap.S().Debugf("PROCESSOR: Time to run %s, interval %s\n", callback.command, callback.interval)
+	cacheFor := callback.interval - time.Second
+	if cacheFor < 0 {
+		cacheFor = 0
+	}
+
+	processor.Rcon.SendRequest(webrcon.Request{Command: callback.command, CacheFor: cacheFor}, func(response *webrcon.Response) {
+		processor.StoreResponse(callback.command, callback.storage, response)
 	})
 }
 
@@ -149,44 +172,23 @@ func (processor *Processor) processCallbackRequests() {
 		if r.ID == -1 {
 			processor.Rcon.Send(r.Command)
 		} else {
-			processor.Rcon.SendCallback(r.Command, 0, processor.buildRequestCallback(r.Command, r.ID))
+			processor.Rcon.SendRequest(webrcon.Request{
+				Command: r.Command,
+				Bypass:  r.BypassCache,
+			}, processor.buildRequestCallback(r.Command, r.ID))
 		}
 	}
 }
 
 // Process the various redis related functions, state maintenance, etc.
 func (processor *Processor) Process(done chan struct{}, wg *sync.WaitGroup) {
-	var ticks int64
-
-	zap.S().Info("Starting up middleware processor")
-	wg.Add(1)
-
-	for {
-		select {
-		case <-done:
-			zap.S().Info("Shutting down middleware processor.")
-			wg.Done()
-			return
-		default:
-		}
-
-		ticks++
-
-		processor.processCallbackRequests()
-
-		for _, callback := range processor.tickcallbacks {
-			// Intervals defined 0 or less are skipped and typically defined as
-			// onconnect callbacks.
-			if callback.interval <= 0 {
-				continue
-			}
-
-			if ticks%int64(callback.interval) == 0 {
-				processor.runTickCallback(callback)
-			}
-		}
-
-		time.Sleep(1 * time.Second)
-		zap.S().Debugf("MIDDLEWARE: Tick Count: %d\n", ticks)
+	err := processor.scheduler.Add(scheduler.Job{
+		Name:     "callback-requests",
+		Interval: 1 * time.Second,
+		Run:      processor.processCallbackRequests})
+	if err != nil {
+		zap.S().Errorf("Unable to schedule RCON callback requests: %s", err)
 	}
+
+	processor.scheduler.Run(done, wg)
 }
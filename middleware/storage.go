@@ -0,0 +1,293 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib"
+	"github.com/diametric/rustcon/rust"
+	"github.com/diametric/rustcon/tengolog"
+	"github.com/diametric/rustcon/webrcon"
+	"go.uber.org/zap"
+)
+
+// StorageMode decides how an interval callback's response is stored.
+type StorageMode string
+
+const (
+	// StorageString sets the key to the value.
+	StorageString StorageMode = "string"
+	// StorageHash sets the key to a hash of the value's fields, replacing
+	// any fields from before.
+	StorageHash StorageMode = "hash"
+	// StorageList pushes the value onto the head of a list, capped to
+	// MaxLength.
+	StorageList StorageMode = "list"
+	// StorageZSet adds the value to a sorted set scored by the unix time it
+	// was stored, capped to the MaxLength newest. An unchanged value only has
+	// its score updated.
+	StorageZSet StorageMode = "zset"
+)
+
+// DefaultHistoryLength caps lists and sorted sets, unless MaxLength is set.
+const DefaultHistoryLength = 100
+
+// ParseStorageMode checks mode is a known storage mode, defaulting to
+// StorageString.
+func ParseStorageMode(mode string) (StorageMode, error) {
+	switch StorageMode(mode) {
+	case "":
+		return StorageString, nil
+	case StorageString, StorageHash, StorageList, StorageZSet:
+		return StorageMode(mode), nil
+	}
+
+	return "", fmt.Errorf("unknown storage mode %s, must be one of string, hash, list or zset", mode)
+}
+
+// Storage is where and how an interval callback stores its response. The
+// value is the response as it is, parsed by the rust package with Parse, or
+// whatever the Transform script makes of it. Every store also sets
+// <Key>:last_updated to the unix time, which never expires, so consumers can
+// tell how old the data is, or was before it expired.
+type Storage struct {
+	Key       string
+	Mode      StorageMode
+	TTL       time.Duration
+	MaxLength int
+	Parse     bool
+	Transform *Transform
+}
+
+// Transform is a Tengo script that turns a response into the value to store.
+// The script gets the response as _INPUT, the command as _COMMAND, the tag as
+// _TAG and the stats scripts' logger(), and sets _VALUE to a string, or to a
+// map or array to store as JSON. Leaving _VALUE undefined stores nothing. It's
+// reloaded when it changes.
+type Transform struct {
+	path     string
+	mu       sync.Mutex
+	modTime  int64
+	compiled *tengo.Compiled
+}
+
+func compileTransform(path string) (*tengo.Compiled, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	script := tengo.NewScript(data)
+	script.EnableFileImport(true)
+	modules := stdlib.GetModuleMap(stdlib.AllModuleNames()...)
+	modules.AddBuiltinModule("rust", rust.TengoModule)
+	script.SetImports(modules)
+
+	_ = script.Add("logger", &tengolog.Logger{})
+	_ = script.Add("_INPUT", nil)
+	_ = script.Add("_COMMAND", nil)
+	_ = script.Add("_TAG", nil)
+
+	return script.Compile()
+}
+
+// NewTransform compiles a transform script.
+func NewTransform(path string) (*Transform, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	compiled, err := compileTransform(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Transform{path: path, modTime: info.ModTime().Unix(), compiled: compiled}, nil
+}
+
+// script returns a copy of the compiled script to run, reloading it first if
+// it's changed. A script that no longer compiles is logged, and the last one
+// that did is kept.
+func (t *Transform) script() *tengo.Compiled {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if info, err := os.Stat(t.path); err == nil && info.ModTime().Unix() != t.modTime {
+		t.modTime = info.ModTime().Unix()
+		compiled, err := compileTransform(t.path)
+		if err != nil {
+			zap.S().Errorf("Unable to reload transform %s, keeping the previous version: %s", t.path, err)
+		} else {
+			zap.S().Infof("Reloaded transform %s", t.path)
+			t.compiled = compiled
+		}
+	}
+
+	return t.compiled.Clone()
+}
+
+// Run runs the script on a response, returning nil if it left _VALUE
+// undefined.
+func (t *Transform) Run(tag string, command string, input string) (interface{}, error) {
+	script := t.script()
+	_ = script.Set("_INPUT", input)
+	_ = script.Set("_COMMAND", command)
+	_ = script.Set("_TAG", tag)
+
+	if err := script.Run(); err != nil {
+		return nil, err
+	}
+
+	value := script.Get("_VALUE")
+	if value == nil || value.IsUndefined() {
+		return nil, nil
+	}
+
+	return value.Value(), nil
+}
+
+// CheckTransform compiles a transform script without using it.
+func CheckTransform(path string) error {
+	_, err := compileTransform(path)
+	return err
+}
+
+// storageValue returns the value to store for a response, or nil to store
+// nothing.
+func (processor *Processor) storageValue(command string, storage *Storage, response *webrcon.Response) (interface{}, error) {
+	switch {
+	case storage.Transform != nil:
+		return storage.Transform.Run(processor.Tag, command, response.Message)
+	case storage.Parse:
+		return rust.Parse(command, response.Message)
+	}
+
+	return response.Message, nil
+}
+
+// encodeValue returns value as it is if it's a string, otherwise as JSON.
+func encodeValue(value interface{}) (string, error) {
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// hashFields flattens a value into hash fields, one per key of an object, or
+// per index of an array. Fields that aren't strings are stored as JSON.
+func hashFields(value interface{}) ([]interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+
+	var fields []interface{}
+	switch decoded := decoded.(type) {
+	case map[string]interface{}:
+		for key, field := range decoded {
+			encoded, err := encodeValue(field)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, key, encoded)
+		}
+	case []interface{}:
+		for i, field := range decoded {
+			encoded, err := encodeValue(field)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, strconv.Itoa(i), encoded)
+		}
+	default:
+		return nil, fmt.Errorf("a hash needs an object or array, not %T", value)
+	}
+
+	return fields, nil
+}
+
+// StoreResponse stores an interval callback's response. A response that can't
+// be parsed or transformed isn't stored.
+func (processor *Processor) StoreResponse(command string, storage *Storage, response *webrcon.Response) {
+	value, err := processor.storageValue(command, storage, response)
+	if err != nil {
+		zap.S().Errorf("Unable to process the response to %s, not storing it: %s", command, err)
+		return
+	}
+	if value == nil {
+		zap.S().Debugf("Transform of %s returned no value, not storing it.", command)
+		return
+	}
+
+	key := strings.ReplaceAll(storage.Key, "{tag}", processor.Tag)
+	now := time.Now()
+
+	maxLength := storage.MaxLength
+	if maxLength <= 0 {
+		maxLength = DefaultHistoryLength
+	}
+
+	var fields []interface{}
+	var encoded string
+	if storage.Mode == StorageHash {
+		fields, err = hashFields(value)
+	} else {
+		encoded, err = encodeValue(value)
+	}
+	if err != nil {
+		zap.S().Errorf("Unable to encode the response to %s, not storing it: %s", command, err)
+		return
+	}
+
+	conn, err := processor.StartPipeline()
+	if err != nil {
+		zap.S().Errorf("Error starting redis pipeline while storing the response to %s: %s", command, err)
+		return
+	}
+	defer conn.Close()
+
+	switch storage.Mode {
+	case StorageHash:
+		// An empty value, e.g. playerlist with nobody online, leaves no hash.
+		conn.Send("DEL", key)
+		if len(fields) > 0 {
+			conn.Send("HSET", append([]interface{}{key}, fields...)...)
+		}
+	case StorageList:
+		conn.Send("LPUSH", key, encoded)
+		conn.Send("LTRIM", key, 0, maxLength-1)
+	case StorageZSet:
+		conn.Send("ZADD", key, now.Unix(), encoded)
+		conn.Send("ZREMRANGEBYRANK", key, 0, -maxLength-1)
+	default:
+		conn.Send("SET", key, encoded)
+	}
+
+	if storage.TTL > 0 {
+		conn.Send("PEXPIRE", key, storage.TTL.Milliseconds())
+	}
+	conn.Send("SET", key+":last_updated", now.Unix())
+
+	if _, err := conn.Do("EXEC"); err != nil {
+		zap.S().Errorf("Error writing to redis in callback: %s", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diametric/rustcon/scheduler"
+	"github.com/diametric/rustcon/systemd"
+	"github.com/diametric/rustcon/webrcon"
+	"go.uber.org/zap"
+)
+
+const notifyInterval = 5 * time.Second
+
+func notify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		zap.S().Warnf("Unable to notify systemd of %s: %s", state, err)
+	}
+}
+
+// checkLiveness returns the first job, or RCON message or command callback,
+// that has stopped advancing.
+func checkLiveness(rcon *webrcon.RconClient, schedulers []*scheduler.Scheduler, grace time.Duration) error {
+	for _, s := range schedulers {
+		if err := s.Check(grace); err != nil {
+			return err
+		}
+	}
+
+	return rcon.Check(grace)
+}
+
+func failedChecks(checks map[string]adminCheck) string {
+	var failed []string
+	for name, check := range checks {
+		if !check.OK {
+			failed = append(failed, name+": "+check.Error)
+		}
+	}
+	sort.Strings(failed)
+
+	return strings.Join(failed, ", ")
+}
+
+// runNotifier is intended to be run as a goroutine, and does nothing unless
+// rustcon was started by systemd with Type=notify. It sends READY=1 once RCON
+// is connected and the readiness checks pass, STATUS= whenever the connection
+// state changes, and, with WatchdogSec set, WATCHDOG=1 only while every
+// scheduler, OnMessage callback and command callback is still advancing, so a
+// wedged rustcon gets restarted.
+func runNotifier(probe *readinessProbe, schedulers []*scheduler.Scheduler, done chan struct{}, wg *sync.WaitGroup) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	wg.Add(1)
+	defer wg.Done()
+
+	watchdog := systemd.Watchdog()
+	interval := notifyInterval
+	if watchdog > 0 && watchdog/2 < interval {
+		interval = watchdog / 2
+	}
+
+	zap.S().Infof("Notifying systemd, watchdog = %s", watchdog)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ready := false
+	status := ""
+	stalled := ""
+	for {
+		next := ""
+		if !ready {
+			if ok, checks := probe.check(context.Background()); ok {
+				ready = true
+				notify("READY=1")
+				zap.S().Info("Ready, notified systemd.")
+			} else {
+				next = "Waiting on " + failedChecks(checks)
+			}
+		}
+
+		if ready {
+			if probe.rcon.Connected() {
+				next = "Connected to RCON"
+			} else {
+				next = "Disconnected from RCON, reconnecting"
+			}
+		}
+
+		if watchdog > 0 {
+			if err := checkLiveness(probe.rcon, schedulers, watchdog/2); err != nil {
+				if err.Error() != stalled {
+					zap.S().Errorf("Not notifying the systemd watchdog, %s", err)
+				}
+				stalled = err.Error()
+				next = "Stalled, " + stalled
+			} else {
+				stalled = ""
+				notify("WATCHDOG=1")
+			}
+		}
+
+		if next != status {
+			status = next
+			notify("STATUS=" + status)
+		}
+
+		select {
+		case <-done:
+			notify("STOPPING=1")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/diametric/rustcon/webrcon"
+)
+
+// runReplay implements the replay subcommand, feeding a recorded RCON session
+// back through the OnMessage callbacks and stats pipeline, with every sink in
+// test mode. Returns the process exit code.
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configFile := flags.String("config", "rustcon.conf", "Path to the configuration file, JSON, YAML or TOML")
+	tag := flags.String("tag", "replay", "Tag to run the stats as")
+	speed := flags.Float64("speed", 1, "Replay speed, 1 for the original speed, 10 for ten times faster, 0 for as fast as possible")
+	wait := flags.Int("wait", 5, "Seconds to keep running after the recording ends, so commands and scripts can finish")
+	debug := flags.Bool("debug", false, "Override log level in config, and set to debug")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [options] recording\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 || *speed < 0 {
+		flags.Usage()
+		return 2
+	}
+
+	config, err := loadconfig(*configFile)
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		return 1
+	}
+
+	frames, err := webrcon.ReadRecording(flags.Arg(0))
+	if err != nil {
+		fmt.Println("Error loading recording:", err)
+		return 1
+	}
+
+	logger, err := buildLogger(config, *debug)
+	if err != nil {
+		panic(err)
+	}
+
+	undo := zap.ReplaceGlobals(logger)
+	defer undo()
+	defer zap.S().Sync()
+
+	overflow, err := webrcon.ParseOverflowPolicy(config.OnMessageOverflow)
+	if err != nil {
+		fmt.Println("Error in onmessage_overflow:", err)
+		return 1
+	}
+
+	rcon := webrcon.RconClient{
+		IgnoreEmptyRconMessages: config.IgnoreEmptyRconMessages,
+		CallOnMessageOnInvoke:   config.CallOnMessageOnInvoke,
+		MessageBuffer:           config.OnMessageBuffer,
+		Overflow:                overflow,
+		CachePolicies:           buildCachePolicies(config)}
+	rcon.InitClient("replay", 0, "")
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	statsclient := buildStatsClient(*tag, config, &rcon, buildSinks(*tag, config), true, done, &wg)
+	go statsclient.CollectStats(done, &wg)
+
+	finished := make(chan struct{})
+	go func() {
+		rcon.Replay(frames, *speed, time.Duration(*wait)*time.Second, done)
+		close(finished)
+	}()
+
+	select {
+	case <-interrupt:
+		zap.S().Warn("CTRL-C caught, exiting.")
+	case <-finished:
+	}
+
+	close(done)
+	wg.Wait()
+	statsclient.CloseSinks()
+
+	return 0
+}
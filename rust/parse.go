@@ -0,0 +1,352 @@
+// Package rust parses the output of common Rust console commands into typed
+// structures, so scripts and the middleware don't need to parse text
+// themselves.
+package rust
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/diametric/rustcon/webrcon"
+)
+
+// Status is the output of "status".
+type Status struct {
+	Hostname   string         `json:"Hostname"`
+	Version    string         `json:"Version"`
+	Map        string         `json:"Map"`
+	Players    int            `json:"Players"`
+	MaxPlayers int            `json:"MaxPlayers"`
+	Queued     int            `json:"Queued"`
+	Joining    int            `json:"Joining"`
+	PlayerList []StatusPlayer `json:"PlayerList"`
+}
+
+// StatusPlayer is a connected player in the output of "status".
+type StatusPlayer struct {
+	SteamID          string  `json:"SteamID"`
+	DisplayName      string  `json:"DisplayName"`
+	Ping             int     `json:"Ping"`
+	ConnectedSeconds float64 `json:"ConnectedSeconds"`
+	Address          string  `json:"Address"`
+	OwnerSteamID     string  `json:"OwnerSteamID"`
+	ViolationLevel   float64 `json:"ViolationLevel"`
+	Kicks            int     `json:"Kicks"`
+}
+
+// ServerInfo is the output of "serverinfo".
+type ServerInfo struct {
+	Hostname          string  `json:"Hostname"`
+	MaxPlayers        int     `json:"MaxPlayers"`
+	Players           int     `json:"Players"`
+	Queued            int     `json:"Queued"`
+	Joining           int     `json:"Joining"`
+	EntityCount       int     `json:"EntityCount"`
+	GameTime          string  `json:"GameTime"`
+	Uptime            int     `json:"Uptime"`
+	Map               string  `json:"Map"`
+	Framerate         float64 `json:"Framerate"`
+	Memory            int     `json:"Memory"`
+	MemoryUsageSystem int     `json:"MemoryUsageSystem"`
+	Collections       int     `json:"Collections"`
+	NetworkIn         int     `json:"NetworkIn"`
+	NetworkOut        int     `json:"NetworkOut"`
+	Restarting        bool    `json:"Restarting"`
+	SaveCreatedTime   string  `json:"SaveCreatedTime"`
+	Version           int     `json:"Version"`
+	Protocol          string  `json:"Protocol"`
+}
+
+// ServerFPS is the output of "server.fps".
+type ServerFPS struct {
+	FPS float64 `json:"FPS"`
+}
+
+// SpawnPopulation is a single spawn population in the output of
+// "spawn.report".
+type SpawnPopulation struct {
+	Name    string  `json:"Name"`
+	Current float64 `json:"Current"`
+	Max     float64 `json:"Max"`
+}
+
+// ClientPerf is a single client's report, logged to the console after
+// "clientperf" is run.
+type ClientPerf struct {
+	SystemMemoryMB int    `json:"SystemMemoryMB"`
+	GPUMemoryMB    int    `json:"GPUMemoryMB"`
+	FPS            int    `json:"FPS"`
+	Uptime         string `json:"Uptime"`
+	UptimeSeconds  int    `json:"UptimeSeconds"`
+	StreamerMode   bool   `json:"StreamerMode"`
+	SteamID        string `json:"SteamID"`
+	DisplayName    string `json:"DisplayName"`
+}
+
+// Parser parses a command's output.
+type Parser func(input string) (interface{}, error)
+
+// Parsers are the parsers of every supported command, by command.
+var Parsers = map[string]Parser{
+	"status":       func(input string) (interface{}, error) { return ParseStatus(input) },
+	"serverinfo":   func(input string) (interface{}, error) { return ParseServerInfo(input) },
+	"playerlist":   func(input string) (interface{}, error) { return ParsePlayerList(input) },
+	"server.fps":   func(input string) (interface{}, error) { return ParseServerFPS(input) },
+	"spawn.report": func(input string) (interface{}, error) { return ParseSpawnReport(input) },
+	"clientperf":   func(input string) (interface{}, error) { return ParseClientPerf(input) },
+}
+
+// Parse parses the output of command, if there's a parser for it.
+func Parse(command string, input string) (interface{}, error) {
+	parser, ok := Parsers[strings.TrimSpace(command)]
+	if !ok {
+		return nil, fmt.Errorf("no parser for %s", command)
+	}
+
+	return parser(input)
+}
+
+// lines splits the output into lines, whether the server is on Linux or
+// Windows.
+func lines(input string) []string {
+	return strings.Split(strings.ReplaceAll(input, "\r\n", "\n"), "\n")
+}
+
+var statusPlayers = regexp.MustCompile(`^(\d+) \((\d+) max\) \((\d+) queued\) \((\d+) joining\)`)
+
+// ParseStatus parses the output of "status".
+func ParseStatus(input string) (*Status, error) {
+	status := &Status{PlayerList: []StatusPlayer{}}
+	header := true
+	found := false
+
+	for _, line := range lines(input) {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if header {
+			key, value, ok := strings.Cut(line, ":")
+			key = strings.TrimSpace(key)
+			if !ok || strings.Contains(key, " ") {
+				// The column headings of the player table.
+				header = false
+				continue
+			}
+
+			found = true
+			value = strings.TrimSpace(value)
+			switch key {
+			case "hostname":
+				status.Hostname = value
+			case "version":
+				status.Version = value
+			case "map":
+				status.Map = value
+			case "players":
+				m := statusPlayers.FindStringSubmatch(value)
+				if m == nil {
+					return nil, fmt.Errorf("unexpected players line %q", value)
+				}
+				status.Players, _ = strconv.Atoi(m[1])
+				status.MaxPlayers, _ = strconv.Atoi(m[2])
+				status.Queued, _ = strconv.Atoi(m[3])
+				status.Joining, _ = strconv.Atoi(m[4])
+			}
+			continue
+		}
+
+		player, err := parseStatusPlayer(line)
+		if err != nil {
+			return nil, err
+		}
+		status.PlayerList = append(status.PlayerList, *player)
+	}
+
+	if !found {
+		return nil, fmt.Errorf("not the output of status")
+	}
+
+	return status, nil
+}
+
+// parseStatusPlayer parses a row of the player table. The name is quoted and
+// may contain spaces, and the owner column is empty unless the player is
+// using family sharing.
+func parseStatusPlayer(line string) (*StatusPlayer, error) {
+	start := strings.Index(line, `"`)
+	end := strings.LastIndex(line, `"`)
+	if start < 0 || end <= start {
+		return nil, fmt.Errorf("unexpected player line %q", line)
+	}
+
+	columns := strings.Fields(line[end+1:])
+	if len(columns) != 5 && len(columns) != 6 {
+		return nil, fmt.Errorf("unexpected player line %q", line)
+	}
+
+	player := &StatusPlayer{
+		SteamID:     strings.TrimSpace(line[:start]),
+		DisplayName: line[start+1 : end],
+		Address:     columns[2],
+	}
+
+	var err error
+	if player.Ping, err = strconv.Atoi(columns[0]); err != nil {
+		return nil, fmt.Errorf("unexpected ping in player line %q", line)
+	}
+	if player.ConnectedSeconds, err = strconv.ParseFloat(strings.TrimSuffix(columns[1], "s"), 64); err != nil {
+		return nil, fmt.Errorf("unexpected connected time in player line %q", line)
+	}
+	if len(columns) == 6 {
+		player.OwnerSteamID = columns[3]
+	}
+	if player.ViolationLevel, err = strconv.ParseFloat(columns[len(columns)-2], 64); err != nil {
+		return nil, fmt.Errorf("unexpected violation level in player line %q", line)
+	}
+	if player.Kicks, err = strconv.Atoi(columns[len(columns)-1]); err != nil {
+		return nil, fmt.Errorf("unexpected kicks in player line %q", line)
+	}
+
+	return player, nil
+}
+
+// ParseServerInfo parses the output of "serverinfo".
+func ParseServerInfo(input string) (*ServerInfo, error) {
+	var info ServerInfo
+	if err := json.Unmarshal([]byte(input), &info); err != nil {
+		return nil, fmt.Errorf("unable to decode serverinfo: %s", err)
+	}
+
+	return &info, nil
+}
+
+// ParsePlayerList parses the output of "playerlist".
+func ParsePlayerList(input string) ([]webrcon.PlayerList, error) {
+	players := []webrcon.PlayerList{}
+	if err := json.Unmarshal([]byte(input), &players); err != nil {
+		return nil, fmt.Errorf("unable to decode playerlist: %s", err)
+	}
+
+	return players, nil
+}
+
+// ParseServerFPS parses the output of "server.fps", e.g. "60 FPS".
+func ParseServerFPS(input string) (*ServerFPS, error) {
+	fields := strings.Fields(input)
+	if len(fields) != 2 || fields[1] != "FPS" {
+		return nil, fmt.Errorf("unexpected server.fps output %q", strings.TrimSpace(input))
+	}
+
+	fps, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected server.fps output %q", strings.TrimSpace(input))
+	}
+
+	return &ServerFPS{FPS: fps}, nil
+}
+
+var spawnPopulation = regexp.MustCompile(`([\d.]+)\s*/\s*([\d.]+)\s*$`)
+
+// ParseSpawnReport parses the output of "spawn.report", where each
+// population's name is followed by a line ending in its current/max count.
+func ParseSpawnReport(input string) ([]SpawnPopulation, error) {
+	populations := []SpawnPopulation{}
+	name := ""
+
+	for _, line := range lines(input) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		m := spawnPopulation.FindStringSubmatch(line)
+		if m == nil || name == "" {
+			if name != "" {
+				return nil, fmt.Errorf("no count for spawn population %s", name)
+			}
+			name = line
+			continue
+		}
+
+		current, _ := strconv.ParseFloat(m[1], 64)
+		limit, _ := strconv.ParseFloat(m[2], 64)
+		populations = append(populations, SpawnPopulation{Name: name, Current: current, Max: limit})
+		name = ""
+	}
+
+	if name != "" {
+		return nil, fmt.Errorf("no count for spawn population %s", name)
+	}
+
+	return populations, nil
+}
+
+var clientPerf = regexp.MustCompile(`(\d+)MB\s*(\d+)MB\s*(\d+)FPS\s*([\dmshd]+)\s*(True|False)\s*(7656\d{13})\s*(.*)`)
+
+// ParseClientPerf parses the client reports logged after "clientperf",
+// ignoring any other lines.
+func ParseClientPerf(input string) ([]ClientPerf, error) {
+	reports := []ClientPerf{}
+
+	for _, line := range lines(input) {
+		m := clientPerf.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		report := ClientPerf{
+			Uptime:       m[4],
+			StreamerMode: m[5] == "True",
+			SteamID:      m[6],
+			DisplayName:  strings.TrimSpace(m[7]),
+		}
+		report.SystemMemoryMB, _ = strconv.Atoi(m[1])
+		report.GPUMemoryMB, _ = strconv.Atoi(m[2])
+		report.FPS, _ = strconv.Atoi(m[3])
+
+		seconds, err := parseUptime(m[4])
+		if err != nil {
+			return nil, err
+		}
+		report.UptimeSeconds = seconds
+
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// parseUptime parses a client's uptime, e.g. 1d2h3m4s.
+func parseUptime(uptime string) (int, error) {
+	units := map[byte]int{'d': 86400, 'h': 3600, 'm': 60, 's': 1}
+
+	seconds := 0
+	value := 0
+	digits := false
+	for i := 0; i < len(uptime); i++ {
+		c := uptime[i]
+		if c >= '0' && c <= '9' {
+			value = value*10 + int(c-'0')
+			digits = true
+			continue
+		}
+
+		unit, ok := units[c]
+		if !ok || !digits {
+			return 0, fmt.Errorf("unexpected uptime %q", uptime)
+		}
+		seconds += value * unit
+		value = 0
+		digits = false
+	}
+
+	if digits {
+		return 0, fmt.Errorf("unexpected uptime %q", uptime)
+	}
+
+	return seconds, nil
+}
@@ -0,0 +1,220 @@
+package rust
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/diametric/rustcon/webrcon"
+)
+
+func readTestdata(t *testing.T, name string) string {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+// crlf converts output to the line endings of a server running on Windows.
+func crlf(input string) string {
+	return strings.ReplaceAll(input, "\n", "\r\n")
+}
+
+var wantStatus = &Status{
+	Hostname:   "[EU] Rusty Vanilla | Weekly: wipe",
+	Version:    "2558 secure (secure mode enabled, connected to Steam3)",
+	Map:        "Procedural Map",
+	Players:    3,
+	MaxPlayers: 150,
+	Queued:     2,
+	Joining:    1,
+	PlayerList: []StatusPlayer{
+		{
+			SteamID:          "76561198012345678",
+			DisplayName:      "Bob",
+			Ping:             32,
+			ConnectedSeconds: 3702.1,
+			Address:          "203.0.113.5:52001",
+			ViolationLevel:   0,
+			Kicks:            0,
+		},
+		{
+			SteamID:          "76561198087654321",
+			DisplayName:      "Big Al the Builder",
+			Ping:             118,
+			ConnectedSeconds: 61,
+			Address:          "198.51.100.23:61234",
+			OwnerSteamID:     "76561198000000042",
+			ViolationLevel:   2.5,
+			Kicks:            1,
+		},
+		{
+			SteamID:          "76561198011112222",
+			DisplayName:      `Mr "Quotes" McGee`,
+			Ping:             7,
+			ConnectedSeconds: 0.5,
+			Address:          "192.0.2.77:50123",
+		},
+	},
+}
+
+var wantPlayerList = []webrcon.PlayerList{
+	{
+		SteamID:          "76561198012345678",
+		OwnerSteamID:     "0",
+		DisplayName:      "Bob",
+		Ping:             32,
+		Address:          "203.0.113.5:52001",
+		ConnectedSeconds: 3702,
+		Health:           87.5,
+	},
+	{
+		SteamID:          "76561198087654321",
+		OwnerSteamID:     "76561198000000042",
+		DisplayName:      `Big Al "the" Builder`,
+		Ping:             118,
+		Address:          "198.51.100.23:61234",
+		ConnectedSeconds: 61,
+		ViolationLevel:   2.5,
+		Health:           100,
+	},
+}
+
+var wantClientPerf = []ClientPerf{
+	{
+		SystemMemoryMB: 6122,
+		GPUMemoryMB:    2843,
+		FPS:            71,
+		Uptime:         "2h12m",
+		UptimeSeconds:  7920,
+		SteamID:        "76561198012345678",
+		DisplayName:    "Bob",
+	},
+	{
+		SystemMemoryMB: 11873,
+		GPUMemoryMB:    7910,
+		FPS:            144,
+		Uptime:         "1d3h4m5s",
+		UptimeSeconds:  97445,
+		StreamerMode:   true,
+		SteamID:        "76561198087654321",
+		DisplayName:    "Big Al the Builder",
+	},
+}
+
+var wantSpawnReport = []SpawnPopulation{
+	{Name: "assets/bundled/prefabs/autospawn/animals", Current: 69, Max: 180},
+	{Name: "assets/bundled/prefabs/autospawn/resource/ores", Current: 2104, Max: 2400},
+	{Name: "assets/bundled/prefabs/autospawn/collectable/hemp", Current: 0, Max: 350},
+}
+
+func TestParse(t *testing.T) {
+	status := readTestdata(t, "status.txt")
+	spawnReport := readTestdata(t, "spawn-report.txt")
+	clientPerf := readTestdata(t, "clientperf.txt")
+
+	tests := []struct {
+		name    string
+		command string
+		input   string
+		want    interface{}
+	}{
+		{"status", "status", status, wantStatus},
+		{"status crlf", "status", crlf(status), wantStatus},
+		{"status nobody online", "status", readTestdata(t, "status-empty.txt"), &Status{
+			Hostname:   "Empty Server",
+			Version:    "2558 secure (secure mode enabled, connected to Steam3)",
+			Map:        "Barren",
+			MaxPlayers: 50,
+			PlayerList: []StatusPlayer{},
+		}},
+		{"serverinfo", "serverinfo", readTestdata(t, "serverinfo.json"), &ServerInfo{
+			Hostname:          "[EU] Rusty Vanilla | Weekly",
+			MaxPlayers:        150,
+			Players:           3,
+			Queued:            2,
+			Joining:           1,
+			EntityCount:       254321,
+			GameTime:          "10/18/2026 14:02:11",
+			Uptime:            86412,
+			Map:               "Procedural Map",
+			Framerate:         59,
+			Memory:            8123,
+			MemoryUsageSystem: 11876,
+			Collections:       1234,
+			NetworkIn:         123456,
+			NetworkOut:        654321,
+			SaveCreatedTime:   "10/14/2026 18:00:05",
+			Version:           2558,
+			Protocol:          "2558.252.1",
+		}},
+		{"playerlist", "playerlist", readTestdata(t, "playerlist.json"), wantPlayerList},
+		{"playerlist crlf", "playerlist", crlf(readTestdata(t, "playerlist.json")), wantPlayerList},
+		{"playerlist nobody online", "playerlist", "[]\n", []webrcon.PlayerList{}},
+		{"server.fps", "server.fps", "60 FPS", &ServerFPS{FPS: 60}},
+		{"server.fps crlf", "server.fps", "143 FPS\r\n", &ServerFPS{FPS: 143}},
+		{"spawn.report", "spawn.report", spawnReport, wantSpawnReport},
+		{"spawn.report crlf", "spawn.report", crlf(spawnReport), wantSpawnReport},
+		{"spawn.report empty", "spawn.report", "", []SpawnPopulation{}},
+		{"clientperf", "clientperf", clientPerf, wantClientPerf},
+		{"clientperf crlf", "clientperf", crlf(clientPerf), wantClientPerf},
+		{"clientperf nobody reported", "clientperf", "", []ClientPerf{}},
+		{"command with whitespace", " server.fps\n", "60 FPS", &ServerFPS{FPS: 60}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Parse(test.command, test.input)
+			if err != nil {
+				t.Fatalf("Parse(%q) returned an error: %s", test.command, err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Parse(%q) =\n%#v\nwant\n%#v", test.command, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	status := readTestdata(t, "status.txt")
+
+	tests := []struct {
+		name    string
+		command string
+		input   string
+	}{
+		{"unknown command", "teleport", "anything"},
+		{"status of something else", "status", "Unknown command: status\n"},
+		{"status empty", "status", ""},
+		{"status bad players line", "status", strings.Replace(status, "3 (150 max)", "three", 1)},
+		{"status unquoted name", "status", status + "76561198000000001 Nobody 1 1s 192.0.2.1:1 0.0 0\n"},
+		{"status missing columns", "status", status + `76561198000000001 "Nobody" 1 1s` + "\n"},
+		{"status bad ping", "status", status + `76561198000000001 "Nobody" fast 1s 192.0.2.1:1 0.0 0` + "\n"},
+		{"status bad connected time", "status", status + `76561198000000001 "Nobody" 1 ages 192.0.2.1:1 0.0 0` + "\n"},
+		{"serverinfo not json", "serverinfo", "Unknown command: serverinfo"},
+		{"serverinfo wrong types", "serverinfo", `{"Players": "lots"}`},
+		{"playerlist not json", "playerlist", "Unknown command: playerlist"},
+		{"playerlist truncated", "playerlist", readTestdata(t, "playerlist.json")[:100]},
+		{"server.fps no number", "server.fps", "FPS"},
+		{"server.fps not a number", "server.fps", "sixty FPS"},
+		{"server.fps something else", "server.fps", "Unknown command: server.fps"},
+		{"spawn.report missing count", "spawn.report", "assets/bundled/prefabs/autospawn/animals\n"},
+		{"spawn.report two names", "spawn.report", "animals\nores\n\tPopulation: 1/2\n"},
+		{"clientperf bad uptime", "clientperf", "6122MB 2843MB 71FPS hm False 76561198012345678 Bob\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := Parse(test.command, test.input); err == nil {
+				t.Errorf("Parse(%q) = %#v, want an error", test.command, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package rust
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/d5/tengo/v2"
+)
+
+// TengoModule is the "rust" module available to scripts, e.g.
+// rust.parse_status(_INPUT). A parse failure returns an error object, which
+// scripts can check for with is_error.
+var TengoModule = map[string]tengo.Object{
+	"parse":              &tengo.UserFunction{Name: "parse", Value: tengoParse},
+	"parse_status":       tengoParser("parse_status", "status"),
+	"parse_serverinfo":   tengoParser("parse_serverinfo", "serverinfo"),
+	"parse_playerlist":   tengoParser("parse_playerlist", "playerlist"),
+	"parse_fps":          tengoParser("parse_fps", "server.fps"),
+	"parse_spawn_report": tengoParser("parse_spawn_report", "spawn.report"),
+	"parse_clientperf":   tengoParser("parse_clientperf", "clientperf"),
+}
+
+// parse(command, input)
+func tengoParse(args ...tengo.Object) (tengo.Object, error) {
+	if len(args) != 2 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+
+	command, ok := tengo.ToString(args[0])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "first",
+			Expected: "string",
+			Found:    args[0].TypeName(),
+		}
+	}
+
+	input, ok := tengo.ToString(args[1])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "second",
+			Expected: "string",
+			Found:    args[1].TypeName(),
+		}
+	}
+
+	return toTengo(Parse(command, input))
+}
+
+// parse_<command>(input)
+func tengoParser(name string, command string) *tengo.UserFunction {
+	return &tengo.UserFunction{
+		Name: name,
+		Value: func(args ...tengo.Object) (tengo.Object, error) {
+			if len(args) != 1 {
+				return nil, tengo.ErrWrongNumArguments
+			}
+
+			input, ok := tengo.ToString(args[0])
+			if !ok {
+				return nil, tengo.ErrInvalidArgumentType{
+					Name:     "first",
+					Expected: "string",
+					Found:    args[0].TypeName(),
+				}
+			}
+
+			return toTengo(Parse(command, input))
+		},
+	}
+}
+
+// toTengo converts a parsed value to maps and arrays keyed the same as its
+// JSON, keeping Go's ints and floats apart.
+func toTengo(parsed interface{}, err error) (tengo.Object, error) {
+	if err != nil {
+		return &tengo.Error{Value: &tengo.String{Value: err.Error()}}, nil
+	}
+
+	return fromValue(reflect.ValueOf(parsed))
+}
+
+func fromValue(v reflect.Value) (tengo.Object, error) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return tengo.UndefinedValue, nil
+		}
+		return fromValue(v.Elem())
+	case reflect.String:
+		return &tengo.String{Value: v.String()}, nil
+	case reflect.Bool:
+		if v.Bool() {
+			return tengo.TrueValue, nil
+		}
+		return tengo.FalseValue, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &tengo.Int{Value: v.Int()}, nil
+	case reflect.Float32, reflect.Float64:
+		return &tengo.Float{Value: v.Float()}, nil
+	case reflect.Slice:
+		a := make([]tengo.Object, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			o, err := fromValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, o)
+		}
+		return &tengo.Array{Value: a}, nil
+	case reflect.Struct:
+		m := make(map[string]tengo.Object, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = field.Name
+			}
+			o, err := fromValue(v.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			m[name] = o
+		}
+		return &tengo.Map{Value: m}, nil
+	}
+
+	return nil, fmt.Errorf("unable to convert %s", v.Type())
+}
@@ -0,0 +1,214 @@
+package scheduler
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Job is a function run every Interval. Runs are anchored to when the
+// scheduler started, so they don't drift by the time each run takes. Offset
+// delays every run by a fixed amount, and Jitter by a random amount up to
+// Jitter, to spread out jobs sharing an interval. A run is skipped, and
+// counted as an overrun, if the previous run is still going.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Offset   time.Duration
+	Jitter   time.Duration
+	Run      func()
+}
+
+// JobStats are the run statistics of a single job.
+type JobStats struct {
+	Name         string        `json:"name"`
+	Interval     time.Duration `json:"interval"`
+	Runs         int64         `json:"runs"`
+	Overruns     int64         `json:"overruns"`
+	Running      bool          `json:"running"`
+	LastRun      time.Time     `json:"last_run"`
+	LastDuration time.Duration `json:"last_duration"`
+	MaxDuration  time.Duration `json:"max_duration"`
+}
+
+type job struct {
+	Job
+	mu      sync.Mutex
+	stats   JobStats
+	next    time.Time
+	started time.Time
+}
+
+// Scheduler runs jobs at their intervals. The zero value is ready to use,
+// jobs must be added before Run is called.
+type Scheduler struct {
+	Name string
+	mu   sync.Mutex
+	jobs []*job
+}
+
+// Add registers a job. The interval must be positive, and the jitter less
+// than the interval.
+func (s *Scheduler) Add(j Job) error {
+	if j.Interval <= 0 {
+		return fmt.Errorf("%s: interval must be greater than 0, found %s", j.Name, j.Interval)
+	}
+
+	if j.Offset < 0 || j.Jitter < 0 {
+		return fmt.Errorf("%s: offset and jitter can't be negative", j.Name)
+	}
+
+	if j.Jitter >= j.Interval {
+		return fmt.Errorf("%s: jitter must be less than the interval of %s, found %s", j.Name, j.Interval, j.Jitter)
+	}
+
+	s.mu.Lock()
+	s.jobs = append(s.jobs, &job{Job: j, stats: JobStats{Name: j.Name, Interval: j.Interval}})
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Stats returns the run statistics of every job, sorted by name.
+func (s *Scheduler) Stats() []JobStats {
+	s.mu.Lock()
+	jobs := s.jobs
+	s.mu.Unlock()
+
+	stats := make([]JobStats, 0, len(jobs))
+	for _, j := range jobs {
+		j.mu.Lock()
+		stats = append(stats, j.stats)
+		j.mu.Unlock()
+	}
+
+	sort.Slice(stats, func(i, k int) bool {
+		return stats[i].Name < stats[k].Name
+	})
+
+	return stats
+}
+
+// Check returns an error if a job has stopped advancing: either its loop
+// hasn't woken up within grace of its next run, or a run has been going for
+// longer than its interval plus grace, e.g. because it's deadlocked.
+func (s *Scheduler) Check(grace time.Duration) error {
+	s.mu.Lock()
+	jobs := s.jobs
+	s.mu.Unlock()
+
+	now := time.Now()
+	for _, j := range jobs {
+		j.mu.Lock()
+		next, started, running := j.next, j.started, j.stats.Running
+		j.mu.Unlock()
+
+		if !next.IsZero() && now.Sub(next) > grace {
+			return fmt.Errorf("%s: %s hasn't run since it was due at %s", s.Name, j.Name, next.Format(time.RFC3339))
+		}
+
+		if running && now.Sub(started) > j.Interval+grace {
+			return fmt.Errorf("%s: %s has been running since %s", s.Name, j.Name, started.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+// Run is intended to be run as a goroutine, and runs every job until done is
+// closed, then waits for any running jobs to finish.
+func (s *Scheduler) Run(done chan struct{}, wg *sync.WaitGroup) {
+	zap.S().Infof("Starting up %s scheduler.", s.Name)
+	wg.Add(1)
+	defer wg.Done()
+
+	s.mu.Lock()
+	jobs := s.jobs
+	s.mu.Unlock()
+
+	var running sync.WaitGroup
+	start := time.Now()
+	for _, j := range jobs {
+		running.Add(1)
+		go s.runJob(j, start, done, &running)
+	}
+
+	<-done
+	running.Wait()
+
+	zap.S().Infof("Shutting down %s scheduler.", s.Name)
+}
+
+func (s *Scheduler) runJob(j *job, start time.Time, done chan struct{}, running *sync.WaitGroup) {
+	defer running.Done()
+
+	anchor := start.Add(j.Offset)
+	for n := int64(1); ; n++ {
+		slot := anchor.Add(time.Duration(n) * j.Interval)
+
+		// Catch up if we've fallen more than an interval behind, e.g. after the
+		// machine was suspended, rather than running every missed slot.
+		if now := time.Now(); now.Sub(slot) > j.Interval {
+			n = int64(now.Sub(anchor)/j.Interval) + 1
+			slot = anchor.Add(time.Duration(n) * j.Interval)
+		}
+
+		at := slot
+		if j.Jitter > 0 {
+			at = at.Add(time.Duration(rand.Int63n(int64(j.Jitter))))
+		}
+
+		j.mu.Lock()
+		j.next = at
+		j.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		j.mu.Lock()
+		if j.stats.Running {
+			j.stats.Overruns++
+			j.mu.Unlock()
+			zap.S().Warnf("SCHEDULER: %s is still running, skipping this run.", j.Name)
+			continue
+		}
+		j.stats.Running = true
+		j.started = time.Now()
+		j.mu.Unlock()
+
+		running.Add(1)
+		go j.run(running)
+	}
+}
+
+func (j *job) run(running *sync.WaitGroup) {
+	defer running.Done()
+
+	started := time.Now()
+	defer func() {
+		took := time.Since(started)
+
+		j.mu.Lock()
+		j.stats.Running = false
+		j.stats.Runs++
+		j.stats.LastRun = started
+		j.stats.LastDuration = took
+		if took > j.stats.MaxDuration {
+			j.stats.MaxDuration = took
+		}
+		j.mu.Unlock()
+
+		zap.S().Debugf("SCHEDULER: Ran %s in %s", j.Name, took)
+	}()
+
+	j.Run()
+}
@@ -0,0 +1,148 @@
+package scheduler
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name  string
+		job   Job
+		valid bool
+	}{
+		{"valid", Job{Name: "valid", Interval: time.Second, Offset: time.Second, Jitter: time.Second / 2}, true},
+		{"no interval", Job{Name: "no interval"}, false},
+		{"negative interval", Job{Name: "negative interval", Interval: -time.Second}, false},
+		{"negative offset", Job{Name: "negative offset", Interval: time.Second, Offset: -time.Second}, false},
+		{"negative jitter", Job{Name: "negative jitter", Interval: time.Second, Jitter: -time.Second}, false},
+		{"jitter equal to interval", Job{Name: "jitter equal to interval", Interval: time.Second, Jitter: time.Second}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var s Scheduler
+			err := s.Add(test.job)
+			if test.valid && err != nil {
+				t.Errorf("Add(%+v) returned an error: %s", test.job, err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("Add(%+v) didn't return an error", test.job)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	const interval = 50 * time.Millisecond
+
+	var mu sync.Mutex
+	var fastRuns []time.Time
+
+	s := &Scheduler{Name: "test"}
+	if err := s.Add(Job{Name: "fast", Interval: interval, Run: func() {
+		mu.Lock()
+		fastRuns = append(fastRuns, time.Now())
+		mu.Unlock()
+
+		// Long enough to add up if runs were scheduled from the end of the
+		// previous one.
+		time.Sleep(10 * time.Millisecond)
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(Job{Name: "slow", Interval: interval, Run: func() {
+		time.Sleep(3*interval + interval/2)
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	start := time.Now()
+	go func() {
+		var wg sync.WaitGroup
+		s.Run(done, &wg)
+		close(stopped)
+	}()
+
+	time.Sleep(time.Second)
+	close(done)
+	<-stopped
+
+	stats := s.Stats()
+	if len(stats) != 2 || stats[0].Name != "fast" || stats[1].Name != "slow" {
+		t.Fatalf("Stats() = %+v, want fast and slow", stats)
+	}
+
+	// 19 slots fit in a second, give or take one at either end.
+	fast, slow := stats[0], stats[1]
+	if fast.Runs < 18 || fast.Runs > 20 || fast.Overruns != 0 {
+		t.Errorf("fast ran %d times with %d overruns, want about 19 with none", fast.Runs, fast.Overruns)
+	}
+
+	// Each slow run takes up its own slot and overruns the next three.
+	if slow.Runs < 4 || slow.Runs > 6 {
+		t.Errorf("slow ran %d times, want about 5", slow.Runs)
+	}
+	if slots := slow.Runs + slow.Overruns; slots < 18 || slots > 20 {
+		t.Errorf("slow ran %d times with %d overruns, want about 19 slots in total", slow.Runs, slow.Overruns)
+	}
+	if slow.Overruns < 2*slow.Runs {
+		t.Errorf("slow overran %d times in %d runs, want about 3 overruns per run", slow.Overruns, slow.Runs)
+	}
+	if slow.MaxDuration < 3*interval {
+		t.Errorf("slow took at most %s, want at least %s", slow.MaxDuration, 3*interval)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for i, at := range fastRuns {
+		want := start.Add(time.Duration(i+1) * interval)
+		if late := at.Sub(want); late < 0 || late > 25*time.Millisecond {
+			t.Errorf("fast run %d was %s late, want it on its slot", i+1, late)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	const interval = 20 * time.Millisecond
+
+	unblock := make(chan struct{})
+	s := &Scheduler{Name: "test"}
+	if err := s.Add(Job{Name: "blocked", Interval: interval, Run: func() {
+		<-unblock
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		s.Run(done, &wg)
+		close(stopped)
+	}()
+	defer func() {
+		close(unblock)
+		close(done)
+		<-stopped
+	}()
+
+	time.Sleep(interval / 2)
+	if err := s.Check(interval); err != nil {
+		t.Fatalf("Check() before the first run returned an error: %s", err)
+	}
+
+	time.Sleep(5 * interval)
+	if err := s.Check(interval); err == nil {
+		t.Fatal("Check() didn't return an error while the job was blocked")
+	}
+
+	stats := s.Stats()
+	if !stats[0].Running || stats[0].Runs != 0 || stats[0].Overruns == 0 {
+		t.Errorf("Stats() = %+v, want one blocked run and overruns", stats[0])
+	}
+}
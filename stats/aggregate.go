@@ -0,0 +1,292 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AggregationConfig summarizes a measurement over a tumbling window instead of
+// writing every point. Fields maps each numeric field to the functions to
+// apply to it, any of count, sum, min, max, mean, or a percentile like p95.
+// The summary is written as <field>_<function>, along with a count of the
+// points seen, once per window and tag set.
+type AggregationConfig struct {
+	Measurement string              `json:"measurement"`
+	Output      string              `json:"output"`
+	Window      int                 `json:"window"`
+	Bucket      string              `json:"bucket"`
+	GroupBy     []string            `json:"group_by"`
+	Fields      map[string][]string `json:"fields"`
+	KeepRaw     bool                `json:"keep_raw"`
+}
+
+type aggregation struct {
+	AggregationConfig
+	window time.Duration
+	start  time.Time
+	series map[string]*aggregateSeries
+}
+
+type aggregateSeries struct {
+	bucket string
+	tags   map[string]string
+	count  int64
+	values map[string][]float64
+}
+
+// Aggregator collects the points of every aggregated measurement, and writes
+// the summaries when their window closes.
+type Aggregator struct {
+	// Write is called with the summaries of every closed window.
+	Write        func(bucket string, points []*Point)
+	mu           sync.Mutex
+	aggregations []*aggregation
+}
+
+func validAggregateFunction(function string) bool {
+	switch function {
+	case "count", "sum", "min", "max", "mean":
+		return true
+	}
+
+	if strings.HasPrefix(function, "p") {
+		p, err := strconv.ParseFloat(function[1:], 64)
+		return err == nil && p >= 0 && p <= 100
+	}
+
+	return false
+}
+
+// Validate checks the aggregation's window and functions.
+func (cfg AggregationConfig) Validate() error {
+	if cfg.Measurement == "" {
+		return fmt.Errorf("measurement is required")
+	}
+
+	if cfg.Window <= 0 {
+		return fmt.Errorf("window must be at least 1 second")
+	}
+
+	for field, functions := range cfg.Fields {
+		for _, function := range functions {
+			if !validAggregateFunction(function) {
+				return fmt.Errorf("field %s: unknown function %s, must be one of count, sum, min, max, mean or pNN", field, function)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Add validates and registers an aggregation.
+func (ag *Aggregator) Add(cfg AggregationConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if cfg.Output == "" {
+		cfg.Output = cfg.Measurement
+	}
+
+	window := time.Duration(cfg.Window) * time.Second
+
+	ag.mu.Lock()
+	ag.aggregations = append(ag.aggregations, &aggregation{
+		AggregationConfig: cfg,
+		window:            window,
+		start:             time.Now().Truncate(window),
+		series:            make(map[string]*aggregateSeries)})
+	ag.mu.Unlock()
+
+	zap.S().Infof("Registered aggregation of %s into %s, window = %ds", cfg.Measurement, cfg.Output, cfg.Window)
+
+	return nil
+}
+
+// Observe adds every aggregated point to its window, and returns the points
+// that should still be written as they are.
+func (ag *Aggregator) Observe(bucket string, points []*Point) []*Point {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	var remaining []*Point
+	for _, p := range points {
+		raw := true
+		for _, a := range ag.aggregations {
+			if p.Name != a.Measurement {
+				continue
+			}
+
+			a.add(bucket, p)
+			raw = raw && a.KeepRaw
+		}
+
+		if raw {
+			remaining = append(remaining, p)
+		}
+	}
+
+	return remaining
+}
+
+func (a *aggregation) add(bucket string, p *Point) {
+	if a.Bucket != "" {
+		bucket = a.Bucket
+	}
+
+	tags := p.Tags
+	if a.GroupBy != nil {
+		tags = make(map[string]string)
+		for _, tag := range a.GroupBy {
+			if v, ok := p.Tags[tag]; ok {
+				tags[tag] = v
+			}
+		}
+	}
+
+	key := bucket + "/" + (&Point{Name: a.Output, Tags: tags}).SeriesKey()
+	s, ok := a.series[key]
+	if !ok {
+		s = &aggregateSeries{bucket: bucket, tags: tags, values: make(map[string][]float64)}
+		a.series[key] = s
+	}
+
+	s.count++
+	for field := range a.Fields {
+		if v, ok := p.FieldFloat(field); ok {
+			s.values[field] = append(s.values[field], v)
+		}
+	}
+}
+
+// percentile returns the pth percentile of sorted values, interpolating
+// between the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+func aggregateValue(function string, sorted []float64) float64 {
+	switch function {
+	case "count":
+		return float64(len(sorted))
+	case "min":
+		return sorted[0]
+	case "max":
+		return sorted[len(sorted)-1]
+	}
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+
+	switch function {
+	case "sum":
+		return sum
+	case "mean":
+		return sum / float64(len(sorted))
+	}
+
+	p, _ := strconv.ParseFloat(function[1:], 64)
+	return percentile(sorted, p)
+}
+
+// summarize returns the summary points of the window, by bucket, and starts
+// the next one.
+func (a *aggregation) summarize(next time.Time) map[string][]*Point {
+	summaries := make(map[string][]*Point)
+	for _, s := range a.series {
+		p := &Point{
+			Name:   a.Output,
+			Tags:   make(map[string]string),
+			Fields: map[string]interface{}{"count": s.count},
+			Time:   a.start}
+
+		for k, v := range s.tags {
+			p.Tags[k] = v
+		}
+
+		for field, functions := range a.Fields {
+			values := s.values[field]
+			if len(values) == 0 {
+				continue
+			}
+			sort.Float64s(values)
+
+			for _, function := range functions {
+				if function == "count" {
+					p.Fields[field+"_count"] = int64(len(values))
+					continue
+				}
+				p.Fields[field+"_"+function] = aggregateValue(function, values)
+			}
+		}
+
+		summaries[s.bucket] = append(summaries[s.bucket], p)
+	}
+
+	a.start = next
+	a.series = make(map[string]*aggregateSeries)
+
+	return summaries
+}
+
+// flush writes the summaries of every window that has closed, or of every
+// window if all is set.
+func (ag *Aggregator) flush(now time.Time, all bool) {
+	ag.mu.Lock()
+
+	var pending []map[string][]*Point
+	for _, a := range ag.aggregations {
+		if !all && now.Before(a.start.Add(a.window)) {
+			continue
+		}
+
+		pending = append(pending, a.summarize(now.Truncate(a.window)))
+	}
+
+	ag.mu.Unlock()
+
+	for _, summaries := range pending {
+		for bucket, points := range summaries {
+			ag.Write(bucket, points)
+		}
+	}
+}
+
+// Run is intended to be run as a goroutine, and writes the summaries as their
+// windows close. Any open windows are written on shutdown.
+func (ag *Aggregator) Run(done chan struct{}, wg *sync.WaitGroup) {
+	zap.S().Info("Starting up aggregator.")
+	wg.Add(1)
+	defer wg.Done()
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			ag.flush(time.Now(), true)
+			zap.S().Info("Shutting down aggregator.")
+			return
+		case now := <-ticker.C:
+			ag.flush(now, false)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package stats
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AlertRuleConfig defines a single declarative alerting rule. Expr is one of:
+//
+//	measurement.field <op> value [for duration]
+//	measurement.field drops by N% in duration
+//	measurement.field rises by N% in duration
+type AlertRuleConfig struct {
+	Name     string            `json:"name"`
+	Expr     string            `json:"expr"`
+	Severity string            `json:"severity"`
+	Message  string            `json:"message"`
+	Tags     map[string]string `json:"tags"`
+	Targets  []string          `json:"targets"`
+}
+
+// AlertSilence mutes notifications for a rule (or "*" for all rules) until
+// the given time. Rule state is still tracked while silenced.
+type AlertSilence struct {
+	Rule    string    `json:"rule"`
+	Until   time.Time `json:"until"`
+	Comment string    `json:"comment"`
+}
+
+// AlertState is the current state of a rule for a single series.
+type AlertState struct {
+	Rule     string    `json:"rule"`
+	Series   string    `json:"series"`
+	State    string    `json:"state"`
+	Value    float64   `json:"value"`
+	Since    time.Time `json:"since"`
+	Silenced bool      `json:"silenced"`
+}
+
+// Alert rule states
+const (
+	AlertStateOK       = "ok"
+	AlertStatePending  = "pending"
+	AlertStateFiring   = "firing"
+	AlertStateResolved = "resolved"
+)
+
+var (
+	thresholdExpr = regexp.MustCompile(`^\s*([^\s.]+)\.(\S+)\s*(<=|>=|==|!=|<|>)\s*(-?[\d.]+)\s*(?:for\s+(\S+))?\s*$`)
+	changeExpr    = regexp.MustCompile(`^\s*([^\s.]+)\.(\S+)\s+(drops|rises)\s+by\s+([\d.]+)%\s+in\s+(\S+)\s*$`)
+)
+
+// A series that hasn't been seen for alertSeriesExpiry times the rule
+// duration, or alertSeriesMinExpiry if that's longer, is dropped, and
+// resolved first if it was firing.
+const (
+	alertSeriesExpiry    = 3
+	alertSeriesMinExpiry = 10 * time.Minute
+)
+
+type alertRule struct {
+	AlertRuleConfig
+	measurement string
+	field       string
+	op          string
+	threshold   float64
+	duration    time.Duration
+	change      string
+	series      map[string]*alertSeries
+}
+
+type alertSample struct {
+	at    time.Time
+	value float64
+}
+
+type alertSeries struct {
+	state   string
+	since   time.Time
+	pending time.Time
+	seen    time.Time
+	value   float64
+	history []alertSample
+}
+
+// AlertManager evaluates the alert rules against every measurement written by
+// the stats scripts, and notifies the rule targets when a rule fires or
+// resolves.
+type AlertManager struct {
+	Tag        string
+	Dispatcher *Dispatcher
+	Silences   []AlertSilence
+	// Publish is called with the state of every rule whenever a rule changes
+	// state, e.g. to store it in redis.
+	Publish func(states []AlertState)
+	mu      sync.Mutex
+	rules   []*alertRule
+}
+
+func parseAlertRule(cfg AlertRuleConfig) (*alertRule, error) {
+	rule := &alertRule{AlertRuleConfig: cfg, series: make(map[string]*alertSeries)}
+
+	if m := thresholdExpr.FindStringSubmatch(cfg.Expr); m != nil {
+		rule.measurement, rule.field, rule.op = m[1], m[2], m[3]
+		threshold, err := strconv.ParseFloat(m[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold %s: %s", m[4], err)
+		}
+		rule.threshold = threshold
+		if m[5] != "" {
+			d, err := time.ParseDuration(m[5])
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration %s: %s", m[5], err)
+			}
+			rule.duration = d
+		}
+		return rule, nil
+	}
+
+	if m := changeExpr.FindStringSubmatch(cfg.Expr); m != nil {
+		rule.measurement, rule.field, rule.change = m[1], m[2], m[3]
+		threshold, err := strconv.ParseFloat(m[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid percentage %s: %s", m[4], err)
+		}
+		rule.threshold = threshold
+		d, err := time.ParseDuration(m[5])
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %s: %s", m[5], err)
+		}
+		rule.duration = d
+		return rule, nil
+	}
+
+	return nil, fmt.Errorf("unable to parse rule expression %q", cfg.Expr)
+}
+
+// Validate checks the rule expression parses.
+func (cfg AlertRuleConfig) Validate() error {
+	_, err := parseAlertRule(cfg)
+	return err
+}
+
+// AddRule parses and registers an alert rule.
+func (am *AlertManager) AddRule(cfg AlertRuleConfig) error {
+	if cfg.Name == "" {
+		cfg.Name = cfg.Expr
+	}
+
+	rule, err := parseAlertRule(cfg)
+	if err != nil {
+		return err
+	}
+
+	am.mu.Lock()
+	am.rules = append(am.rules, rule)
+	am.mu.Unlock()
+
+	zap.S().Infof("Registered alert rule %s: %s", cfg.Name, cfg.Expr)
+
+	return nil
+}
+
+func (rule *alertRule) matches(p *Point) bool {
+	if p.Name != rule.measurement {
+		return false
+	}
+
+	for k, v := range rule.Tags {
+		if p.Tags[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func compareThreshold(op string, value float64, threshold float64) bool {
+	switch op {
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "==":
+		return value == threshold
+	case "!=":
+		return value != threshold
+	}
+
+	return false
+}
+
+// breached updates the series with the new value, and returns whether the
+// rule condition has been met for long enough to fire.
+func (rule *alertRule) breached(s *alertSeries, now time.Time, value float64) bool {
+	if rule.change == "" {
+		if !compareThreshold(rule.op, value, rule.threshold) {
+			s.pending = time.Time{}
+			return false
+		}
+
+		if s.pending.IsZero() {
+			s.pending = now
+		}
+
+		return now.Sub(s.pending) >= rule.duration
+	}
+
+	s.history = append(s.history, alertSample{at: now, value: value})
+	for len(s.history) > 0 && now.Sub(s.history[0].at) > rule.duration {
+		s.history = s.history[1:]
+	}
+
+	// Compare against the highest (for drops) or lowest (for rises) value
+	// seen in the window.
+	ref := s.history[0].value
+	for _, h := range s.history {
+		if (rule.change == "drops" && h.value > ref) || (rule.change == "rises" && h.value < ref) {
+			ref = h.value
+		}
+	}
+
+	if ref == 0 {
+		return false
+	}
+
+	pct := (value - ref) / ref * 100
+	if rule.change == "drops" {
+		return -pct >= rule.threshold
+	}
+
+	return pct >= rule.threshold
+}
+
+func (am *AlertManager) silenced(rule string, now time.Time) bool {
+	for _, s := range am.Silences {
+		if (s.Rule == rule || s.Rule == "*") && now.Before(s.Until) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Observe evaluates every rule against the points written by a script.
+func (am *AlertManager) Observe(points []*Point) {
+	am.mu.Lock()
+
+	changed := false
+	now := time.Now()
+	for _, p := range points {
+		for _, rule := range am.rules {
+			if !rule.matches(p) {
+				continue
+			}
+
+			value, ok := p.FieldFloat(rule.field)
+			if !ok {
+				continue
+			}
+
+			key := p.SeriesKey()
+			s, ok := rule.series[key]
+			if !ok {
+				s = &alertSeries{state: AlertStateOK, since: now}
+				rule.series[key] = s
+			}
+			s.value = value
+			s.seen = now
+
+			var next string
+			if rule.breached(s, now, value) {
+				next = AlertStateFiring
+			} else if s.state == AlertStateFiring {
+				next = AlertStateResolved
+			} else if !s.pending.IsZero() {
+				next = AlertStatePending
+			} else {
+				next = AlertStateOK
+			}
+
+			if next == s.state {
+				continue
+			}
+
+			s.state = next
+			s.since = now
+			changed = true
+
+			if next == AlertStateFiring || next == AlertStateResolved {
+				am.notify(rule, key, s, now)
+			}
+		}
+	}
+
+	if am.expireLocked(now) {
+		changed = true
+	}
+
+	var states []AlertState
+	if changed && am.Publish != nil {
+		states = am.statesLocked(now)
+	}
+
+	am.mu.Unlock()
+
+	if states != nil {
+		am.Publish(states)
+	}
+}
+
+// expireLocked drops the series that stopped being written, e.g. a player
+// that left, so they don't stay firing forever. It returns whether any were
+// dropped.
+func (am *AlertManager) expireLocked(now time.Time) bool {
+	expired := false
+	for _, rule := range am.rules {
+		expiry := rule.duration * alertSeriesExpiry
+		if expiry < alertSeriesMinExpiry {
+			expiry = alertSeriesMinExpiry
+		}
+
+		for key, s := range rule.series {
+			if now.Sub(s.seen) < expiry {
+				continue
+			}
+
+			if s.state == AlertStateFiring {
+				s.state = AlertStateResolved
+				s.since = now
+				am.notify(rule, key, s, now)
+			}
+
+			delete(rule.series, key)
+			expired = true
+		}
+	}
+
+	return expired
+}
+
+func (am *AlertManager) notify(rule *alertRule, series string, s *alertSeries, now time.Time) {
+	zap.S().Infof("Alert %s is %s for %s, value = %v", rule.Name, s.state, series, s.value)
+
+	if am.silenced(rule.Name, now) {
+		zap.S().Infof("Alert %s is silenced, not notifying.", rule.Name)
+		return
+	}
+
+	if am.Dispatcher == nil {
+		return
+	}
+
+	message := rule.Message
+	if message == "" {
+		message = rule.Expr
+	}
+
+	severity := rule.Severity
+	if s.state == AlertStateResolved {
+		severity = AlertStateResolved
+	}
+
+	for _, target := range rule.Targets {
+		_, err := am.Dispatcher.EnqueueTarget(target, &Alert{
+			Key:      fmt.Sprintf("rule:%s:%s:%s", rule.Name, series, s.state),
+			Severity: severity,
+			Message: fmt.Sprintf("%s %s on %s: %s (value = %v)",
+				rule.Name, strings.ToUpper(s.state), am.Tag, message, s.value),
+		})
+		if err != nil {
+			zap.S().Errorf("Unable to notify for alert %s: %s", rule.Name, err)
+		}
+	}
+}
+
+func (am *AlertManager) statesLocked(now time.Time) []AlertState {
+	states := []AlertState{}
+	for _, rule := range am.rules {
+		silenced := am.silenced(rule.Name, now)
+		for key, s := range rule.series {
+			states = append(states, AlertState{
+				Rule:     rule.Name,
+				Series:   key,
+				State:    s.state,
+				Value:    s.value,
+				Since:    s.since,
+				Silenced: silenced,
+			})
+		}
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Rule != states[j].Rule {
+			return states[i].Rule < states[j].Rule
+		}
+		return states[i].Series < states[j].Series
+	})
+
+	return states
+}
+
+// States returns the current state of every rule and series.
+func (am *AlertManager) States() []AlertState {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	return am.statesLocked(time.Now())
+}
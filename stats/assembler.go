@@ -0,0 +1,139 @@
+package stats
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diametric/rustcon/webrcon"
+	"go.uber.org/zap"
+)
+
+// Assembler joins log entries that Rust splits across several RCON messages,
+// such as an error followed by its stack trace, back into a single message.
+// A message matching one of the Headers is held for up to Window, and any
+// following messages matching Continuation are appended to it, one per line,
+// and to its Stacktrace. Every other message is passed straight through.
+//
+// Register it with OnMessage, which delivers messages in order from a single
+// goroutine. Output is called with the lock held, either from that goroutine
+// or from the timer flushing a held entry, so it's never called concurrently
+// and sees messages in the order they arrived.
+type Assembler struct {
+	Headers      []*regexp.Regexp
+	Continuation *regexp.Regexp
+	Window       time.Duration
+	MaxLines     int
+	// IncludeInvoked passes command responses through as well, the same as
+	// call_onmessage_on_invoke.
+	IncludeInvoked bool
+	// Output is called with every assembled message.
+	Output  func(message []byte)
+	mu      sync.Mutex
+	pending *assembledEntry
+}
+
+type assembledEntry struct {
+	response webrcon.Response
+	lines    []string
+	timer    *time.Timer
+}
+
+// DefaultContinuation matches the lines of a .NET stack trace.
+var DefaultContinuation = regexp.MustCompile(`^(\s|at\s)`)
+
+// OnMessage implements the RCON client OnMessage callback.
+func (a *Assembler) OnMessage(message []byte) {
+	var r webrcon.Response
+	if err := json.Unmarshal(message, &r); err != nil {
+		return
+	}
+
+	if r.Identifier >= webrcon.StartingIdentifier && !a.IncludeInvoked {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.pending != nil {
+		if a.continues(&r) {
+			a.pending.lines = append(a.pending.lines, strings.TrimRight(r.Message, "\r\n"))
+			if a.MaxLines > 0 && len(a.pending.lines) >= a.MaxLines {
+				a.flushLocked()
+			} else {
+				a.pending.timer.Reset(a.Window)
+			}
+			return
+		}
+
+		a.flushLocked()
+	}
+
+	if !a.isHeader(&r) {
+		a.Output(message)
+		return
+	}
+
+	entry := &assembledEntry{response: r}
+	entry.timer = time.AfterFunc(a.Window, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		if a.pending == entry {
+			a.flushLocked()
+		}
+	})
+	a.pending = entry
+}
+
+func (a *Assembler) isHeader(r *webrcon.Response) bool {
+	for _, header := range a.Headers {
+		if header.MatchString(r.Message) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *Assembler) continues(r *webrcon.Response) bool {
+	if r.Identifier != a.pending.response.Identifier {
+		return false
+	}
+
+	continuation := a.Continuation
+	if continuation == nil {
+		continuation = DefaultContinuation
+	}
+
+	return continuation.MatchString(r.Message)
+}
+
+// flushLocked sends the pending entry. The caller must hold a.mu.
+func (a *Assembler) flushLocked() {
+	entry := a.pending
+	a.pending = nil
+	entry.timer.Stop()
+
+	r := entry.response
+	if len(entry.lines) > 0 {
+		trace := strings.Join(entry.lines, "\n")
+		r.Message = strings.TrimRight(r.Message, "\r\n") + "\n" + trace
+		if r.Stacktrace == "" {
+			r.Stacktrace = trace
+		} else {
+			r.Stacktrace += "\n" + trace
+		}
+	}
+
+	message, err := json.Marshal(&r)
+	if err != nil {
+		zap.S().Errorf("Error encoding assembled message: %s", err)
+		return
+	}
+
+	a.Output(message)
+}
@@ -0,0 +1,236 @@
+package stats
+
+import (
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/token"
+)
+
+// These functions operate on _GLOBALS while holding globalsLock for the whole
+// read-modify-write, so scripts don't need lock()/unlock() for the common
+// counter and buffer patterns.
+
+func globalsKeyArg(args []tengo.Object) (string, error) {
+	key, ok := tengo.ToString(args[0])
+	if !ok {
+		return "", tengo.ErrInvalidArgumentType{
+			Name:     "first",
+			Expected: "string",
+			Found:    args[0].TypeName(),
+		}
+	}
+
+	return key, nil
+}
+
+// CanCall returns true since we're a function type.
+func (o *TengoGlobalsIncr) CanCall() bool {
+	return true
+}
+
+// TypeName returns the function name
+func (o *TengoGlobalsIncr) TypeName() string {
+	return "globals_incr"
+}
+
+// String returns the function name
+func (o *TengoGlobalsIncr) String() string {
+	return "globals_incr"
+}
+
+// Call atomically adds delta (default 1) to a key and returns the new value.
+// A missing key starts at 0. Ints stay ints unless delta is a float.
+// globals_incr(key, [optional]delta)
+func (o *TengoGlobalsIncr) Call(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+
+	key, err := globalsKeyArg(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var delta tengo.Object = &tengo.Int{Value: 1}
+	if len(args) > 1 {
+		switch args[1].(type) {
+		case *tengo.Int, *tengo.Float:
+			delta = args[1]
+		default:
+			return nil, tengo.ErrInvalidArgumentType{
+				Name:     "second",
+				Expected: "int or float",
+				Found:    args[1].TypeName(),
+			}
+		}
+	}
+
+	globalsLock.Lock()
+	defer globalsLock.Unlock()
+
+	current, ok := getGlobal(key)
+	if !ok {
+		current = &tengo.Int{Value: 0}
+	}
+
+	switch current.(type) {
+	case *tengo.Int, *tengo.Float:
+	default:
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "first",
+			Expected: "key holding an int or float",
+			Found:    current.TypeName(),
+		}
+	}
+
+	ret, err = current.BinaryOp(token.Add, delta)
+	if err != nil {
+		return nil, err
+	}
+
+	setGlobal(key, ret)
+
+	return ret, nil
+}
+
+// CanCall returns true since we're a function type.
+func (o *TengoGlobalsCAS) CanCall() bool {
+	return true
+}
+
+// TypeName returns the function name
+func (o *TengoGlobalsCAS) TypeName() string {
+	return "globals_cas"
+}
+
+// String returns the function name
+func (o *TengoGlobalsCAS) String() string {
+	return "globals_cas"
+}
+
+// Call atomically sets a key to new only if it currently equals old, returning
+// true if the swap happened. An old value of undefined matches a missing key.
+// globals_cas(key, old, new)
+func (o *TengoGlobalsCAS) Call(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 3 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+
+	key, err := globalsKeyArg(args)
+	if err != nil {
+		return nil, err
+	}
+
+	globalsLock.Lock()
+	defer globalsLock.Unlock()
+
+	current, ok := getGlobal(key)
+	if !ok {
+		current = tengo.UndefinedValue
+	}
+
+	if !current.Equals(args[1]) {
+		return tengo.FalseValue, nil
+	}
+
+	setGlobal(key, args[2])
+
+	return tengo.TrueValue, nil
+}
+
+// CanCall returns true since we're a function type.
+func (o *TengoGlobalsAppend) CanCall() bool {
+	return true
+}
+
+// TypeName returns the function name
+func (o *TengoGlobalsAppend) TypeName() string {
+	return "globals_append"
+}
+
+// String returns the function name
+func (o *TengoGlobalsAppend) String() string {
+	return "globals_append"
+}
+
+// Call atomically appends values to the array held by a key, creating it if
+// needed, and returns the new length. A new array is stored rather than
+// modifying the old one in place, since other scripts may still hold it.
+// globals_append(key, value, ...)
+func (o *TengoGlobalsAppend) Call(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) < 2 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+
+	key, err := globalsKeyArg(args)
+	if err != nil {
+		return nil, err
+	}
+
+	globalsLock.Lock()
+	defer globalsLock.Unlock()
+
+	var values []tengo.Object
+	if current, ok := getGlobal(key); ok {
+		switch current := current.(type) {
+		case *tengo.Array:
+			values = current.Value
+		case *tengo.ImmutableArray:
+			values = current.Value
+		case *tengo.Undefined:
+		default:
+			return nil, tengo.ErrInvalidArgumentType{
+				Name:     "first",
+				Expected: "key holding an array",
+				Found:    current.TypeName(),
+			}
+		}
+	}
+
+	updated := make([]tengo.Object, 0, len(values)+len(args)-1)
+	updated = append(updated, values...)
+	updated = append(updated, args[1:]...)
+
+	setGlobal(key, &tengo.Array{Value: updated})
+
+	return &tengo.Int{Value: int64(len(updated))}, nil
+}
+
+// CanCall returns true since we're a function type.
+func (o *TengoGlobalsGetSet) CanCall() bool {
+	return true
+}
+
+// TypeName returns the function name
+func (o *TengoGlobalsGetSet) TypeName() string {
+	return "globals_getset"
+}
+
+// String returns the function name
+func (o *TengoGlobalsGetSet) String() string {
+	return "globals_getset"
+}
+
+// Call atomically sets a key and returns its previous value, or undefined.
+// globals_getset(key, value)
+func (o *TengoGlobalsGetSet) Call(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 2 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+
+	key, err := globalsKeyArg(args)
+	if err != nil {
+		return nil, err
+	}
+
+	globalsLock.Lock()
+	defer globalsLock.Unlock()
+
+	current, ok := getGlobal(key)
+	if !ok {
+		current = tengo.UndefinedValue
+	}
+
+	setGlobal(key, args[1])
+
+	return current, nil
+}
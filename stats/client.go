@@ -1,7 +1,6 @@
 package stats
 
 import (
-	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -11,17 +10,19 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/d5/tengo/v2"
 	"github.com/d5/tengo/v2/stdlib"
 	"go.uber.org/zap"
 
+	"github.com/diametric/rustcon/rust"
+	"github.com/diametric/rustcon/scheduler"
 	"github.com/diametric/rustcon/webrcon"
 	"github.com/fatih/structs"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go"
-	"github.com/influxdata/influxdb-client-go/api"
 )
 
 func (client *Client) checkNeedReload(scriptpath string, modTime int64) (bool, int64) {
@@ -40,6 +41,30 @@ func (client *Client) checkNeedReload(scriptpath string, modTime int64) (bool, i
 	return false, 0
 }
 
+// reloadIfChanged recompiles the stat's script if it changed on disk. It
+// returns false if the changed script couldn't be compiled, in which case the
+// stat shouldn't run.
+func (client *Client) reloadIfChanged(kind string, stat *StatsImpl) bool {
+	needs, modtime := client.checkNeedReload(stat.scriptpath, stat.modTime)
+	if !needs {
+		return true
+	}
+
+	zap.S().Infof("%s: Change detected in %s, reloading", kind, stat.scriptpath)
+	script, err := client.getScript(stat.scriptpath)
+	if err != nil {
+		zap.S().Errorf("Error reloading new script %s: %s", stat.scriptpath, err)
+		stat.state.recordRun(err)
+		return false
+	}
+
+	stat.script = script
+	stat.modTime = modtime
+	stat.state.recordReload()
+
+	return true
+}
+
 func (client *Client) getScript(scriptpath string) (*tengo.Compiled, error) {
 	scriptdata, err := ioutil.ReadFile(scriptpath)
 	if err != nil {
@@ -48,32 +73,99 @@ func (client *Client) getScript(scriptpath string) (*tengo.Compiled, error) {
 
 	script := tengo.NewScript(scriptdata)
 	script.EnableFileImport(true)
-	script.SetImports(stdlib.GetModuleMap(stdlib.AllModuleNames()...))
+	modules := stdlib.GetModuleMap(stdlib.AllModuleNames()...)
+	modules.AddBuiltinModule("rust", rust.TengoModule)
+	script.SetImports(modules)
 
 	// Here we add all possible variables, but set them to nil.
 
 	_ = script.Add("discord_webhook", nil)
 	_ = script.Add("slack_webhook", nil)
+	_ = script.Add("http_webhook", nil)
+	_ = script.Add("notify", nil)
 	_ = script.Add("logger", nil)
 	_ = script.Add("lock", nil)
 	_ = script.Add("unlock", nil)
+	if !declaresGlobal(scriptdata, "with_lock") {
+		_ = script.Add("with_lock", nil)
+	}
 	_ = script.Add("tagescape", nil)
 	_ = script.Add("fieldescape", nil)
+	_ = script.Add("measurement", nil)
+	_ = script.Add("globals_keys", nil)
+	_ = script.Add("globals_delete", nil)
+	_ = script.Add("globals_expire", nil)
+	_ = script.Add("globals_ttl", nil)
+	_ = script.Add("globals_incr", nil)
+	_ = script.Add("globals_cas", nil)
+	_ = script.Add("globals_append", nil)
+	_ = script.Add("globals_getset", nil)
 
 	_ = script.Add("_TAG", nil)
 	_ = script.Add("_SCRIPT_TYPE", nil)
 	_ = script.Add("_GLOBALS", nil)
 	_ = script.Add("_INPUT", nil)
 	_ = script.Add("_MATCHES", nil)
+	_ = script.Add("_NAMED", nil)
 	_ = script.Add("_RESPONSE", nil)
 	_ = script.Add("_RCON_STATS", nil)
 	_ = script.Add("_RUNTIME_STATS", nil)
+	_ = script.Add("_MONITORED_STATS", nil)
+	_ = script.Add("_SCHEDULER_STATS", nil)
 
 	return script.Compile()
 }
 
+// CheckScript compiles a stat script without registering it.
+func CheckScript(scriptpath string) error {
+	_, err := (&Client{}).getScript(scriptpath)
+	return err
+}
+
+// CheckMonitoredStat compiles a monitored stat's pattern, and checks a
+// script-less stat has a measurement, and fields and tags matching the named
+// groups of the pattern.
+func CheckMonitoredStat(pattern string, scriptpath string, options MonitoredStatOptions) (*regexp.Regexp, error) {
+	compiled, err := compileMonitoredPattern(pattern, options)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compile monitored regex %s: %s", pattern, err)
+	}
+
+	if scriptpath != "" {
+		return compiled, nil
+	}
+
+	if options.Measurement == "" {
+		return nil, fmt.Errorf("monitored stat %s needs either a script or a measurement", pattern)
+	}
+
+	if err := options.validateNamed(compiled); err != nil {
+		return nil, fmt.Errorf("monitored stat %s: %s", pattern, err)
+	}
+
+	return compiled, nil
+}
+
 // RegisterMonitoredStat registers a stat based on monitoring the RCON data.
-func (client *Client) RegisterMonitoredStat(pattern string, scriptpath string) {
+func (client *Client) RegisterMonitoredStat(pattern string, scriptpath string, options MonitoredStatOptions) {
+	compiled, err := CheckMonitoredStat(pattern, scriptpath, options)
+	if err != nil {
+		zap.S().Errorf("Unable to add monitored stat: %s", err)
+		return
+	}
+
+	stat := &MonitoredStats{
+		MonitoredStatOptions: options,
+		pattern:              pattern,
+		patternCompiled:      compiled,
+	}
+
+	if scriptpath == "" {
+		client.monitoredStats = append(client.monitoredStats, stat)
+		zap.S().Infof("Registered monitored stat, pattern = %s, measurement = %s", pattern, options.Measurement)
+		return
+	}
+
 	file, err := os.Stat(scriptpath)
 	if err != nil {
 		zap.S().Errorf("Error getting file modification time on %s: %s", scriptpath, err)
@@ -86,27 +178,18 @@ func (client *Client) RegisterMonitoredStat(pattern string, scriptpath string) {
 		return
 	}
 
-	compiled, err := regexp.Compile(pattern)
-	if err != nil {
-		zap.S().Errorf("Unable to compile monitored regex %s: %s", pattern, err)
-		return
+	stat.StatsImpl = StatsImpl{
+		scriptpath: scriptpath,
+		script:     script,
+		modTime:    file.ModTime().Unix(),
 	}
-
-	client.monitoredStats = append(client.monitoredStats, &MonitoredStats{
-		StatsImpl: StatsImpl{
-			scriptpath: scriptpath,
-			script:     script,
-			modTime:    file.ModTime().Unix(),
-		},
-		pattern:         pattern,
-		patternCompiled: compiled,
-	})
+	client.monitoredStats = append(client.monitoredStats, stat)
 
 	zap.S().Infof("Registered monitored stat, pattern = %s, script = %s", pattern, scriptpath)
 }
 
 // RegisterInternalStat registers an internal type stat.
-func (client *Client) RegisterInternalStat(scriptpath string, interval int) {
+func (client *Client) RegisterInternalStat(scriptpath string, interval time.Duration, offset time.Duration, jitter time.Duration) {
 	file, err := os.Stat(scriptpath)
 	if err != nil {
 		zap.S().Errorf("Error getting file modification time on %s: %s", scriptpath, err)
@@ -119,20 +202,35 @@ func (client *Client) RegisterInternalStat(scriptpath string, interval int) {
 		return
 	}
 
-	client.internalStats = append(client.internalStats, &InternalStats{
+	stat := &InternalStats{
 		StatsImpl: StatsImpl{
 			scriptpath: scriptpath,
 			script:     script,
 			modTime:    file.ModTime().Unix(),
 		},
 		interval: interval,
-	})
+		offset:   offset,
+		jitter:   jitter,
+	}
+
+	err = client.scheduler.Add(scheduler.Job{
+		Name:     "internal:" + scriptpath,
+		Interval: interval,
+		Offset:   offset,
+		Jitter:   jitter,
+		Run:      func() { client.runInternalStat(stat) }})
+	if err != nil {
+		zap.S().Warnf("Unable to add internal stat %s: %s", scriptpath, err)
+		return
+	}
 
-	zap.S().Infof("Registered internal stat, interval = %d, script = %s", interval, scriptpath)
+	client.internalStats = append(client.internalStats, stat)
+
+	zap.S().Infof("Registered internal stat, interval = %s, script = %s", interval, scriptpath)
 }
 
 // RegisterInvokedStat registers an invoked type stat.
-func (client *Client) RegisterInvokedStat(command string, scriptpath string, interval int) {
+func (client *Client) RegisterInvokedStat(command string, scriptpath string, interval time.Duration, offset time.Duration, jitter time.Duration) {
 	file, err := os.Stat(scriptpath)
 	if err != nil {
 		zap.S().Errorf("Error getting file modification time on %s: %s", scriptpath, err)
@@ -145,17 +243,32 @@ func (client *Client) RegisterInvokedStat(command string, scriptpath string, int
 		return
 	}
 
-	client.stats = append(client.stats, &Stats{
+	stat := &Stats{
 		StatsImpl: StatsImpl{
 			scriptpath: scriptpath,
 			script:     script,
 			modTime:    file.ModTime().Unix(),
 		},
 		interval: interval,
+		offset:   offset,
+		jitter:   jitter,
 		command:  command,
-	})
+	}
 
-	zap.S().Infof("Registered invoked stat, command = %s, interval = %d, script = %s", command, interval, scriptpath)
+	err = client.scheduler.Add(scheduler.Job{
+		Name:     "invoked:" + command,
+		Interval: interval,
+		Offset:   offset,
+		Jitter:   jitter,
+		Run:      func() { client.runInvokedStat(stat) }})
+	if err != nil {
+		zap.S().Warnf("Unable to add invoked stat %s: %s", scriptpath, err)
+		return
+	}
+
+	client.stats = append(client.stats, stat)
+
+	zap.S().Infof("Registered invoked stat, command = %s, interval = %s, script = %s", command, interval, scriptpath)
 }
 
 // InitClient establishes the InfluxDB connection and sets up queues
@@ -181,73 +294,171 @@ func (client *Client) InitClient(host string, port int, database string, usernam
 				InsecureSkipVerify: true,
 			}))
 
+	client.AddSink(&InfluxSink{Client: client.influxDb, Database: database})
+}
+
+// AddSink adds a destination for the measurements written by the stats
+// scripts.
+func (client *Client) AddSink(sink Sink) {
+	client.Sinks = append(client.Sinks, sink)
+	zap.S().Infof("Writing measurements to the %s sink.", sink.Name())
 }
 
-func (client *Client) runScript(script *tengo.Compiled) {
+// CloseSinks closes the files of the file sinks. It's called on shutdown once
+// everything writing measurements, including the aggregator's final flush, has
+// finished, so nothing writes to a closed file.
+func (client *Client) CloseSinks() {
+	for _, sink := range client.Sinks {
+		if sink, ok := sink.(*FileSink); ok {
+			if err := sink.File.Close(); err != nil {
+				zap.S().Errorf("Error closing %s: %s", sink.File.Path, err)
+			}
+		}
+	}
+}
+
+// runScript runs a stat's script and writes its measurements. It returns the
+// error the script failed with, if any.
+func (client *Client) runScript(name string, script *tengo.Compiled) error {
+	locks := newScriptLocks(name)
+	defer locks.releaseAll()
+
 	_ = script.Set("_GLOBALS", &TengoGlobals{})
 	_ = script.Set("_TAG", client.Tag)
-	_ = script.Set("discord_webhook", &TengoDiscordWebhook{})
-	_ = script.Set("slack_webhook", &TengoSlackWebhook{})
+	var targets map[string]*NotificationTarget
+	if client.Dispatcher != nil {
+		targets = client.Dispatcher.Targets
+	}
+
+	_ = script.Set("discord_webhook", &TengoDiscordWebhook{test: client.Test, targets: targets})
+	_ = script.Set("slack_webhook", &TengoSlackWebhook{test: client.Test, targets: targets})
+	_ = script.Set("http_webhook", &TengoHTTPWebhook{tag: client.Tag, test: client.Test, targets: targets})
+	_ = script.Set("notify", &TengoNotify{dispatcher: client.Dispatcher})
 	_ = script.Set("logger", &TengoLogger{})
-	_ = script.Set("lock", &TengoLock{})
-	_ = script.Set("unlock", &TengoUnlock{})
+	_ = script.Set("lock", &TengoLock{locks: locks})
+	_ = script.Set("unlock", &TengoUnlock{locks: locks})
+	if withLock, err := newWithLock(locks); err != nil {
+		zap.S().Errorf("STATS: Unable to set up with_lock for %s: %s", name, err)
+	} else {
+		_ = script.Set("with_lock", withLock)
+	}
 	_ = script.Set("tagescape", &TengoTagEscape{})
 	_ = script.Set("fieldescape", &TengoFieldEscape{})
+	_ = script.Set("measurement", &TengoMeasurement{})
+	_ = script.Set("globals_keys", &TengoGlobalsKeys{})
+	_ = script.Set("globals_delete", &TengoGlobalsDelete{})
+	_ = script.Set("globals_expire", &TengoGlobalsExpire{})
+	_ = script.Set("globals_ttl", &TengoGlobalsTTL{})
+	_ = script.Set("globals_incr", &TengoGlobalsIncr{})
+	_ = script.Set("globals_cas", &TengoGlobalsCAS{})
+	_ = script.Set("globals_append", &TengoGlobalsAppend{})
+	_ = script.Set("globals_getset", &TengoGlobalsGetSet{})
 
 	err := script.Run()
 
 	if err != nil {
-		zap.S().Errorf("Error running tengo script: %s", err)
-		return
+		zap.S().Errorf("Error running tengo script %s: %s", name, err)
+		return err
 	}
 
 	// Here we allow the individual script to determine the InfluxDB bucket
 	// to store data. By default we use autogen.
 	var bucket string
 	b := script.Get("_BUCKET")
-	if b == nil {
+	if b == nil || b.IsUndefined() {
 		bucket = "autogen"
 	} else {
 		bucket = b.String()
 	}
 
-	var writeAPI api.WriteAPIBlocking
-	if !client.Test {
-		writeAPI = client.influxDb.WriteAPIBlocking(
-			"", fmt.Sprintf("%s/%s", client.database, bucket))
+	var elements []tengo.Object
+	switch m := script.Get("_MEASUREMENTS").Object().(type) {
+	case *tengo.Array:
+		elements = m.Value
+	case *tengo.ImmutableArray:
+		elements = m.Value
 	}
 
-	measurements := script.Get("_MEASUREMENTS")
-	if measurements != nil && measurements.Array() != nil && len(measurements.Array()) > 0 {
-		var linedata strings.Builder
-		for _, m := range measurements.Array() {
-			linedata.WriteString(fmt.Sprintf("%v\n", m))
+	var points []*Point
+	for i, m := range elements {
+		// Validate every element, so one bad line or record doesn't fail the
+		// write of the whole batch.
+		p, err := pointFromElement(m)
+		if err != nil {
+			zap.S().Errorf("Dropping invalid measurement %d from %s: %s. Value: %s", i, name, err, m)
+			continue
 		}
 
-		if !client.Test {
-			zap.S().Debugf("Writing out InfluxDB record: %s", linedata.String())
-			err := writeAPI.WriteRecord(context.Background(), linedata.String())
-			if err != nil {
-				zap.S().Error("Error writing InfluxDB record: ", err)
+		points = append(points, p)
+	}
+
+	client.writePoints(name, bucket, points)
+
+	return nil
+}
+
+// writePoints adds the default tags to the points, evaluates the alert rules
+// against them, and writes them to every sink.
+func (client *Client) writePoints(name string, bucket string, points []*Point) {
+	if len(points) == 0 {
+		return
+	}
+
+	for _, p := range points {
+		for k, v := range client.DefaultTags {
+			if _, ok := p.Tags[k]; !ok {
+				p.Tags[k] = v
 			}
-		} else {
-			zap.S().Infof("TEST: InfluxDB record, database = %s, bucket  = %s\nData:\n%s", client.database, bucket, linedata.String())
 		}
 	}
+
+	if client.Alerts != nil {
+		client.Alerts.Observe(points)
+	}
+
+	if client.Aggregator != nil {
+		points = client.Aggregator.Observe(bucket, points)
+	}
+
+	client.sinkPoints(name, bucket, points)
 }
 
-func (client *Client) runInternalStat(stat *InternalStats) {
-	if needs, modtime := client.checkNeedReload(stat.scriptpath, stat.modTime); needs {
-		var err error
+// WriteSummaries writes the summaries from the aggregator. They're checked by
+// the alert rules, but not aggregated again.
+func (client *Client) WriteSummaries(bucket string, points []*Point) {
+	if client.Alerts != nil {
+		client.Alerts.Observe(points)
+	}
 
-		zap.S().Infof("internal: Change detected in %s, reloading", stat.scriptpath)
-		stat.script, err = client.getScript(stat.scriptpath)
-		if err != nil {
-			zap.S().Errorf("Error reloading new script %s: %s", stat.scriptpath, err)
-			return
+	client.sinkPoints("aggregator", bucket, points)
+}
+
+func (client *Client) sinkPoints(name string, bucket string, points []*Point) {
+	if len(points) == 0 {
+		return
+	}
+
+	if client.Test {
+		var linedata strings.Builder
+		for _, p := range points {
+			line, _ := p.LineProtocol()
+			linedata.WriteString(line + "\n")
 		}
+		zap.S().Infof("TEST: Measurements, database = %s, bucket  = %s\nData:\n%s", client.database, bucket, linedata.String())
+		return
+	}
 
-		stat.modTime = modtime
+	for _, sink := range client.Sinks {
+		zap.S().Debugf("Writing %d measurements from %s to %s", len(points), name, sink.Name())
+		if err := sink.Write(bucket, points); err != nil {
+			zap.S().Errorf("Error writing measurements to %s: %s", sink.Name(), err)
+		}
+	}
+}
+
+func (client *Client) runInternalStat(stat *InternalStats) {
+	if !client.reloadIfChanged("internal", &stat.StatsImpl) {
+		return
 	}
 
 	var m runtime.MemStats
@@ -264,26 +475,26 @@ func (client *Client) runInternalStat(stat *InternalStats) {
 	if err != nil {
 		zap.S().Errorf("ERROR: Couldn't populate _RUNTIME_STATS: %s", err)
 	}
-	_ = stat.script.Set("_RCON_STATS", structs.Map(client.Rcon.Stats))
+	_ = stat.script.Set("_RCON_STATS", structs.Map(client.Rcon.StatsSnapshot()))
+	_ = stat.script.Set("_MONITORED_STATS", client.MonitoredStatsCounters())
+	_ = stat.script.Set("_SCHEDULER_STATS", client.SchedulerStats())
 
-	client.runScript(stat.script.Clone())
+	stat.state.recordRun(client.runScript(stat.scriptpath, stat.script.Clone()))
 }
 
 func (client *Client) runInvokedStat(stat *Stats) {
 	zap.S().Debugf("STATS: Running %s", stat.command)
 
-	client.Rcon.SendCallback(stat.command, stat.interval-1, func(response *webrcon.Response) {
-		if needs, modtime := client.checkNeedReload(stat.scriptpath, stat.modTime); needs {
-			var err error
-
-			zap.S().Infof("invoked: Change detected in %s, reloading", stat.scriptpath)
-			stat.script, err = client.getScript(stat.scriptpath)
-			if err != nil {
-				zap.S().Errorf("Error reloading new script %s: %s", stat.scriptpath, err)
-				return
-			}
+	// The response is cached until just before the next run, so stats sharing
+	// a command share a response, but a run never gets the last run's.
+	cacheFor := stat.interval - time.Second
+	if cacheFor < 0 {
+		cacheFor = 0
+	}
 
-			stat.modTime = modtime
+	client.Rcon.SendRequest(webrcon.Request{Command: stat.command, CacheFor: cacheFor}, func(response *webrcon.Response) {
+		if !client.reloadIfChanged("invoked", &stat.StatsImpl) {
+			return
 		}
 
 		zap.S().Debugf("Running callback for %s", stat.command)
@@ -294,10 +505,46 @@ func (client *Client) runInvokedStat(stat *Stats) {
 		if err != nil {
 			zap.S().Errorf("STATS: Unable to add _RESPONSE variable to script: %s", err)
 		}
-		client.runScript(stat.script.Clone())
+		stat.state.recordRun(client.runScript(stat.scriptpath, stat.script.Clone()))
 	})
 }
 
+// compileMonitoredPattern compiles the pattern with the flags set in the
+// options.
+func compileMonitoredPattern(pattern string, options MonitoredStatOptions) (*regexp.Regexp, error) {
+	var flags string
+	if options.DotAll {
+		flags += "s"
+	}
+	if options.Multiline {
+		flags += "m"
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+
+	return regexp.Compile(pattern)
+}
+
+// wants returns whether the pattern should be run against the message, based
+// on the type filter and literal prefilter.
+func (v *MonitoredStats) wants(r *webrcon.Response) bool {
+	if len(v.Types) > 0 {
+		found := false
+		for _, t := range v.Types {
+			if strings.EqualFold(t, r.Type) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return v.Contains == "" || strings.Contains(r.Message, v.Contains)
+}
+
 // OnMessageMonitoredStat implements the RCON client OnMessage callback, to be
 // used for Monitored Stats.
 func (client *Client) OnMessageMonitoredStat(message []byte) {
@@ -305,23 +552,31 @@ func (client *Client) OnMessageMonitoredStat(message []byte) {
 
 	if err := json.Unmarshal(message, &r); err != nil {
 		zap.S().Error("Error decoding RCON websocket response in OnMessage callback, this shouldn't should never happen here.")
+		return
 	}
 
 	for _, v := range client.monitoredStats {
+		if !v.wants(&r) {
+			atomic.AddInt64(&v.skipped, 1)
+			continue
+		}
+
 		zap.S().Debugf("MONITORED STATS: Checking if %s matches %s", v.pattern, r.Message)
+		start := time.Now()
 		re := v.patternCompiled.FindStringSubmatch(r.Message)
+		atomic.AddInt64(&v.regexTime, int64(time.Since(start)))
+		atomic.AddInt64(&v.checks, 1)
+
 		if re != nil {
-			if needs, modtime := client.checkNeedReload(v.scriptpath, v.modTime); needs {
-				var err error
+			atomic.AddInt64(&v.matches, 1)
 
-				zap.S().Infof("monitored: Change detected in %s, reloading", v.scriptpath)
-				v.script, err = client.getScript(v.scriptpath)
-				if err != nil {
-					zap.S().Errorf("Error reloading new script %s: %s", v.scriptpath, err)
-					continue
-				}
+			if v.script == nil {
+				v.state.recordRun(client.writeNamedStat(v, namedMatches(v.patternCompiled, re)))
+				continue
+			}
 
-				v.modTime = modtime
+			if !client.reloadIfChanged("monitored", &v.StatsImpl) {
+				continue
 			}
 
 			converted := make([]interface{}, len(re))
@@ -334,48 +589,91 @@ func (client *Client) OnMessageMonitoredStat(message []byte) {
 			if err != nil {
 				zap.S().Errorf("STATS: Unable to add _MATCHES variable to script: %s", err)
 			}
+			err = v.script.Set("_NAMED", namedMatchesObject(v.patternCompiled, re))
+			if err != nil {
+				zap.S().Errorf("STATS: Unable to add _NAMED variable to script: %s", err)
+			}
 			err = v.script.Set("_RESPONSE", structs.Map(r))
 			if err != nil {
 				zap.S().Errorf("STATS: Unable to add _RESPONSE variable to script: %s", err)
 			}
 
-			client.runScript(v.script.Clone())
+			v.state.recordRun(client.runScript(v.scriptpath, v.script.Clone()))
 		}
 	}
 }
 
-// CollectStats begins running the configured stats.
-func (client *Client) CollectStats(done chan struct{}, wg *sync.WaitGroup) {
-	var ticks int64
+// writeNamedStat writes the point of a script-less monitored stat. It returns
+// the error if the point couldn't be built from the named groups.
+func (client *Client) writeNamedStat(v *MonitoredStats, named map[string]string) error {
+	p, err := v.pointFromNamed(named)
+	if err != nil {
+		zap.S().Errorf("Dropping invalid measurement from monitored stat %s: %s", v.Measurement, err)
+		return err
+	}
 
-	zap.S().Info("Starting up stats collector.")
-	wg.Add(1)
+	bucket := v.Bucket
+	if bucket == "" {
+		bucket = "autogen"
+	}
 
-	for {
-		select {
-		case <-done:
-			zap.S().Info("Shutting down stats collector.")
-			wg.Done()
-			return
-		default:
-		}
+	client.writePoints(v.Measurement, bucket, []*Point{p})
 
-		ticks++
+	return nil
+}
 
-		for _, stat := range client.stats {
-			if ticks%int64(stat.interval) == 0 {
-				client.runInvokedStat(stat)
-			}
-		}
+// MonitoredStatsCounters returns the counters of every monitored stat:
+// messages checked against the pattern, messages skipped by the type filter
+// or prefilter, matches, and the total time spent in the regex.
+func (client *Client) MonitoredStatsCounters() []interface{} {
+	counters := make([]interface{}, 0, len(client.monitoredStats))
+	for _, v := range client.monitoredStats {
+		counters = append(counters, map[string]interface{}{
+			"pattern":       v.pattern,
+			"script":        v.scriptpath,
+			"checks":        atomic.LoadInt64(&v.checks),
+			"skipped":       atomic.LoadInt64(&v.skipped),
+			"matches":       atomic.LoadInt64(&v.matches),
+			"regex_time_ns": atomic.LoadInt64(&v.regexTime),
+		})
+	}
 
-		for _, internalStat := range client.internalStats {
-			if ticks%int64(internalStat.interval) == 0 {
-				client.runInternalStat(internalStat)
+	return counters
+}
+
+// SchedulerStats returns the run statistics of every scheduled job, for
+// _SCHEDULER_STATS.
+func (client *Client) SchedulerStats() []interface{} {
+	schedulers := append([]*scheduler.Scheduler{&client.scheduler}, client.Schedulers...)
+
+	stats := []interface{}{}
+	for _, s := range schedulers {
+		for _, job := range s.Stats() {
+			var lastRun int64
+			if !job.LastRun.IsZero() {
+				lastRun = job.LastRun.UnixNano()
 			}
+
+			stats = append(stats, map[string]interface{}{
+				"scheduler":        s.Name,
+				"name":             job.Name,
+				"interval_ns":      int64(job.Interval),
+				"runs":             job.Runs,
+				"overruns":         job.Overruns,
+				"running":          job.Running,
+				"last_run":         lastRun,
+				"last_duration_ns": int64(job.LastDuration),
+				"max_duration_ns":  int64(job.MaxDuration),
+			})
 		}
+	}
 
-		time.Sleep(1 * time.Second)
+	return stats
+}
 
-		zap.S().Debugf("STATS: Tick Count: %d", ticks)
-	}
+// CollectStats runs the invoked and internal stats at their intervals, until
+// done is closed.
+func (client *Client) CollectStats(done chan struct{}, wg *sync.WaitGroup) {
+	client.scheduler.Name = "stats"
+	client.scheduler.Run(done, wg)
 }
@@ -2,8 +2,11 @@ package stats
 
 import (
 	"regexp"
+	"time"
 
 	"github.com/d5/tengo/v2"
+	"github.com/diametric/rustcon/scheduler"
+	"github.com/diametric/rustcon/tengolog"
 	"github.com/diametric/rustcon/webrcon"
 	influxdb2 "github.com/influxdata/influxdb-client-go"
 )
@@ -13,11 +16,20 @@ type Client struct {
 	Tag            string
 	Rcon           *webrcon.RconClient
 	Test           bool
+	Dispatcher     *Dispatcher
+	Alerts         *AlertManager
+	Aggregator     *Aggregator
+	Sinks          []Sink
+	DefaultTags    map[string]string
 	influxDb       influxdb2.Client
 	database       string
 	stats          []*Stats
 	internalStats  []*InternalStats
 	monitoredStats []*MonitoredStats
+	// Schedulers are any other schedulers whose job stats are passed to
+	// internal stats, along with the stats collector's own.
+	Schedulers []*scheduler.Scheduler
+	scheduler  scheduler.Scheduler
 }
 
 // StatsImpl defines the data all stat types use.
@@ -25,34 +37,64 @@ type StatsImpl struct {
 	scriptpath string
 	script     *tengo.Compiled
 	modTime    int64
+	state      statState
 }
 
 // InternalStats stats, or rather stats that just run at an interval with not RCON command.
 type InternalStats struct {
 	StatsImpl
-	interval int
+	interval time.Duration
+	offset   time.Duration
+	jitter   time.Duration
 }
 
 // MonitoredStats style stats.
 type MonitoredStats struct {
+	// Counters are first to keep them 64-bit aligned for atomic access.
+	checks    int64
+	skipped   int64
+	matches   int64
+	regexTime int64
 	StatsImpl
+	MonitoredStatOptions
 	pattern         string
 	patternCompiled *regexp.Regexp
 }
 
+// MonitoredStatOptions limits which messages a monitored stat's pattern is
+// run against. Types only matches messages of the given types (e.g. Generic,
+// Chat, Error), and Contains skips the regex for any message not containing
+// the literal string. DotAll lets . match newlines, and Multiline makes ^ and
+// $ match at line breaks.
+//
+// Measurement, Tags and Fields define a monitored stat without a script, that
+// writes a point built straight from the pattern's named groups. Tags lists
+// the groups to use as tags, and Fields maps each group to use as a field to
+// its type, one of string, int, float or bool.
+type MonitoredStatOptions struct {
+	Types       []string
+	Contains    string
+	DotAll      bool
+	Multiline   bool
+	Measurement string
+	Bucket      string
+	Tags        []string
+	Fields      map[string]string
+}
+
 // Stats contains the configured stats plugins
 type Stats struct {
 	StatsImpl
-	interval int
+	interval time.Duration
+	offset   time.Duration
+	jitter   time.Duration
 	command  string
 }
 
 // Tengo related data structures
 
 // TengoLogger defines the object type for the logger functions
-type TengoLogger struct {
-	tengo.ObjectImpl
-}
+type TengoLogger = tengolog.Logger
 
 // TengoGlobals defines the object that holds globals. We need this to enforce
 // concurrency safety.
@@ -60,14 +102,56 @@ type TengoGlobals struct {
 	tengo.ObjectImpl
 }
 
-// TengoLock defines the object type for a generic mutex lock function
+// TengoGlobalsKeys defines the object type for listing the keys in _GLOBALS
+type TengoGlobalsKeys struct {
+	tengo.ObjectImpl
+}
+
+// TengoGlobalsDelete defines the object type for deleting a key from _GLOBALS
+type TengoGlobalsDelete struct {
+	tengo.ObjectImpl
+}
+
+// TengoGlobalsExpire defines the object type for setting a TTL on a _GLOBALS key
+type TengoGlobalsExpire struct {
+	tengo.ObjectImpl
+}
+
+// TengoGlobalsTTL defines the object type for reading the TTL of a _GLOBALS key
+type TengoGlobalsTTL struct {
+	tengo.ObjectImpl
+}
+
+// TengoGlobalsIncr defines the object type for atomically incrementing a _GLOBALS key
+type TengoGlobalsIncr struct {
+	tengo.ObjectImpl
+}
+
+// TengoGlobalsCAS defines the object type for compare-and-swap on a _GLOBALS key
+type TengoGlobalsCAS struct {
+	tengo.ObjectImpl
+}
+
+// TengoGlobalsAppend defines the object type for atomically appending to a _GLOBALS array
+type TengoGlobalsAppend struct {
+	tengo.ObjectImpl
+}
+
+// TengoGlobalsGetSet defines the object type for atomically swapping a _GLOBALS value
+type TengoGlobalsGetSet struct {
+	tengo.ObjectImpl
+}
+
+// TengoLock defines the object type for the named mutex lock function
 type TengoLock struct {
 	tengo.ObjectImpl
+	locks *scriptLocks
 }
 
-// TengoUnlock defines the object type for a generic mutex unlock function
+// TengoUnlock defines the object type for the named mutex unlock function
 type TengoUnlock struct {
 	tengo.ObjectImpl
+	locks *scriptLocks
 }
 
 // TengoTagEscape defines the object type for escaping tag values
@@ -80,12 +164,35 @@ type TengoFieldEscape struct {
 	tengo.ObjectImpl
 }
 
+// TengoMeasurement defines the object for building a line protocol measurement
+type TengoMeasurement struct {
+	tengo.ObjectImpl
+}
+
 // TengoDiscordWebhook defines the object for sending a discord webhook
 type TengoDiscordWebhook struct {
 	tengo.ObjectImpl
+	test    bool
+	targets map[string]*NotificationTarget
 }
 
 // TengoSlackWebhook defines the object for sending a slack webhook
 type TengoSlackWebhook struct {
 	tengo.ObjectImpl
+	test    bool
+	targets map[string]*NotificationTarget
+}
+
+// TengoHTTPWebhook defines the object for sending a webhook to a notification target
+type TengoHTTPWebhook struct {
+	tengo.ObjectImpl
+	tag     string
+	test    bool
+	targets map[string]*NotificationTarget
+}
+
+// TengoNotify defines the object for queueing an alert with the dispatcher
+type TengoNotify struct {
+	tengo.ObjectImpl
+	dispatcher *Dispatcher
 }
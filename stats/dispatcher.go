@@ -0,0 +1,410 @@
+package stats
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"go.uber.org/zap"
+)
+
+// Alert is a single notification queued for asynchronous delivery.
+type Alert struct {
+	Kind     string
+	URL      string
+	Key      string
+	Severity string
+	Message  string
+	Username string
+	Target   *NotificationTarget
+}
+
+// Dispatcher delivers alerts in the background so scripts never wait on a
+// webhook. Each destination gets its own queue and worker, so a slow or rate
+// limited destination only delays itself. Alerts sharing a key are only sent
+// once per cooldown, with a summary of how many were suppressed sent after.
+// On shutdown the workers deliver whatever is still queued, without waiting
+// on the rate limit or retrying. In test mode alerts are logged instead of
+// sent.
+type Dispatcher struct {
+	Tag          string
+	Test         bool
+	Cooldown     int
+	MaxPerMinute int
+	MaxRetries   int
+	QueueSize    int
+	Targets      map[string]*NotificationTarget
+	mu           sync.Mutex
+	destinations map[string]chan *Alert
+	suppressed   map[string]*suppression
+	stopped      bool
+	stopping     chan struct{}
+	workers      sync.WaitGroup
+}
+
+type suppression struct {
+	alert *Alert
+	until time.Time
+	count int
+}
+
+// InitDispatcher sets up the dispatcher, filling in defaults for anything
+// not configured.
+func (d *Dispatcher) InitDispatcher() {
+	if d.Cooldown < 0 {
+		d.Cooldown = 0
+	}
+	if d.MaxPerMinute <= 0 {
+		d.MaxPerMinute = 30
+	}
+	if d.MaxRetries < 0 {
+		d.MaxRetries = 0
+	}
+	if d.QueueSize <= 0 {
+		d.QueueSize = 100
+	}
+
+	for name, target := range d.Targets {
+		if err := target.InitTarget(name); err != nil {
+			zap.S().Errorf("Disabling notification target: %s", err)
+			delete(d.Targets, name)
+		}
+	}
+
+	d.destinations = make(map[string]chan *Alert)
+	d.suppressed = make(map[string]*suppression)
+	d.stopping = make(chan struct{})
+}
+
+// Run watches for expired cooldowns and sends their summaries. Workers for
+// each destination are started on demand, and once done is closed Run waits
+// for them to drain their queues before returning.
+func (d *Dispatcher) Run(done chan struct{}, wg *sync.WaitGroup) {
+	zap.S().Info("Starting up alert dispatcher.")
+	wg.Add(1)
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			zap.S().Info("Shutting down alert dispatcher.")
+			d.stop()
+			wg.Done()
+			return
+		case <-ticker.C:
+			d.flushSuppressed()
+		}
+	}
+}
+
+// Enqueue queues an alert for delivery. It returns false if the alert was a
+// duplicate inside its cooldown, or the destination queue is full.
+func (d *Dispatcher) Enqueue(alert *Alert) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dedup := ""
+	if alert.Key != "" && d.Cooldown > 0 {
+		dedup = alert.URL + "|" + alert.Key
+		if s, ok := d.suppressed[dedup]; ok && time.Now().Before(s.until) {
+			s.count++
+			return false
+		}
+	}
+
+	if !d.queue(alert) {
+		return false
+	}
+
+	// Only an alert that was actually queued starts a cooldown, so a dropped
+	// one doesn't suppress the next.
+	if dedup != "" {
+		d.suppressed[dedup] = &suppression{
+			alert: alert,
+			until: time.Now().Add(time.Duration(d.Cooldown) * time.Second),
+		}
+	}
+
+	return true
+}
+
+// EnqueueTarget fills in the destination of the alert from a named target and
+// queues it.
+func (d *Dispatcher) EnqueueTarget(name string, alert *Alert) (bool, error) {
+	target, ok := d.Targets[name]
+	if !ok {
+		return false, fmt.Errorf("unknown notification target %s", name)
+	}
+
+	alert.Kind = target.Type
+	alert.URL = target.URL
+	alert.Target = target
+
+	return d.Enqueue(alert), nil
+}
+
+// QueueSizes returns the number of pending alerts per destination kind.
+func (d *Dispatcher) QueueSizes() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sizes := make(map[string]int)
+	for dest, q := range d.destinations {
+		kind := strings.SplitN(dest, "|", 2)[0]
+		sizes[kind] += len(q)
+	}
+
+	return sizes
+}
+
+// queue puts the alert on its destination's queue, starting a worker for it
+// if this is the first alert there. The caller must hold d.mu.
+func (d *Dispatcher) queue(alert *Alert) bool {
+	if d.stopped {
+		zap.S().Warnf("Alert dispatcher is shutting down, dropping %s alert: %s", alert.Kind, alert.Message)
+		return false
+	}
+
+	dest := alert.Kind + "|" + alert.URL
+
+	q, ok := d.destinations[dest]
+	if !ok {
+		q = make(chan *Alert, d.QueueSize)
+		d.destinations[dest] = q
+		d.workers.Add(1)
+		go d.worker(alert.Kind, q)
+	}
+
+	select {
+	case q <- alert:
+		return true
+	default:
+		zap.S().Warnf("Alert queue for %s is full, dropping alert: %s", alert.Kind, alert.Message)
+		return false
+	}
+}
+
+func (d *Dispatcher) flushSuppressed() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for k, s := range d.suppressed {
+		if now.Before(s.until) {
+			continue
+		}
+
+		delete(d.suppressed, k)
+		if s.count == 0 {
+			continue
+		}
+
+		d.queue(&Alert{
+			Kind:     s.alert.Kind,
+			URL:      s.alert.URL,
+			Severity: s.alert.Severity,
+			Username: s.alert.Username,
+			Target:   s.alert.Target,
+			Message: fmt.Sprintf("%d similar alerts suppressed in the last %ds: %s",
+				s.count, d.Cooldown, s.alert.Message),
+		})
+	}
+}
+
+// stop closes every destination queue, so no more alerts are queued, and
+// waits for the workers to deliver what's left in them.
+func (d *Dispatcher) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	for _, q := range d.destinations {
+		close(q)
+	}
+	d.mu.Unlock()
+
+	close(d.stopping)
+	d.workers.Wait()
+}
+
+// sleep waits for wait, returning false straight away if the dispatcher is
+// stopping.
+func (d *Dispatcher) sleep(wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-d.stopping:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (d *Dispatcher) worker(kind string, q chan *Alert) {
+	defer d.workers.Done()
+
+	gap := time.Minute / time.Duration(d.MaxPerMinute)
+	var last time.Time
+
+	for alert := range q {
+		if wait := gap - time.Since(last); wait > 0 {
+			d.sleep(wait)
+		}
+
+		for attempt := 0; ; attempt++ {
+			last = time.Now()
+			resp, err := d.deliverAlert(alert)
+			if err == nil && resp.StatusCode < 300 {
+				break
+			}
+
+			if err == nil {
+				err = fmt.Errorf("status %d: %s", resp.StatusCode, resp.Body)
+				// Client errors won't get better by retrying.
+				if resp.StatusCode < 500 && resp.StatusCode != 429 {
+					attempt = d.MaxRetries
+				}
+			}
+
+			if attempt >= d.MaxRetries {
+				zap.S().Errorf("Giving up delivering %s alert after %d attempts: %s", kind, attempt+1, err)
+				break
+			}
+
+			backoff := time.Duration(1<<uint(attempt)) * time.Second
+			zap.S().Warnf("Error delivering %s alert, retrying in %s: %s", kind, backoff, err)
+			if !d.sleep(backoff) {
+				zap.S().Errorf("Giving up delivering %s alert, shutting down: %s", kind, err)
+				break
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) deliverAlert(alert *Alert) (*webhookResponse, error) {
+	if d.Test {
+		zap.S().Infof("TEST: %s alert to %s: [%s] %s", alert.Kind, alert.URL, alert.Severity, alert.Message)
+		return &webhookResponse{StatusCode: 200}, nil
+	}
+
+	target := alert.Target
+	if target == nil {
+		target = &NotificationTarget{Type: alert.Kind, URL: alert.URL}
+	}
+
+	// The alert's username overrides the target's, without modifying the
+	// shared target.
+	if alert.Username != "" && alert.Username != target.Username {
+		t := *target
+		t.Username = alert.Username
+		target = &t
+	}
+
+	return target.Send(&TargetTemplateData{
+		Tag:      d.Tag,
+		Message:  alert.Message,
+		Severity: alert.Severity,
+		Key:      alert.Key,
+	})
+}
+
+// CanCall returns true since we're a function type.
+func (o *TengoNotify) CanCall() bool {
+	return true
+}
+
+// TypeName returns the function name
+func (o *TengoNotify) TypeName() string {
+	return "notify"
+}
+
+// String returns the function name
+func (o *TengoNotify) String() string {
+	return "notify"
+}
+
+// Call queues an alert with the dispatcher. Returns true if it was queued,
+// false if it was suppressed as a duplicate or dropped.
+// notify({type, url, message, [optional]key, severity, username})
+// notify({target, message, [optional]key, severity, username})
+func (o *TengoNotify) Call(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 1 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+
+	if o.dispatcher == nil {
+		return nil, fmt.Errorf("notify: alert dispatcher is not running")
+	}
+
+	var fields map[string]tengo.Object
+	switch m := args[0].(type) {
+	case *tengo.Map:
+		fields = m.Value
+	case *tengo.ImmutableMap:
+		fields = m.Value
+	default:
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "first",
+			Expected: "map",
+			Found:    args[0].TypeName(),
+		}
+	}
+
+	alert := &Alert{}
+	var target string
+	for k, dst := range map[string]*string{
+		"target":   &target,
+		"type":     &alert.Kind,
+		"url":      &alert.URL,
+		"message":  &alert.Message,
+		"key":      &alert.Key,
+		"severity": &alert.Severity,
+		"username": &alert.Username,
+	} {
+		if v, ok := fields[k]; ok {
+			s, ok := tengo.ToString(v)
+			if !ok {
+				return nil, tengo.ErrInvalidArgumentType{
+					Name:     k,
+					Expected: "string",
+					Found:    v.TypeName(),
+				}
+			}
+			*dst = s
+		}
+	}
+
+	if target != "" {
+		if alert.Message == "" {
+			return nil, fmt.Errorf("notify: message is required")
+		}
+
+		queued, err := o.dispatcher.EnqueueTarget(target, alert)
+		if err != nil {
+			return nil, err
+		}
+
+		return tengo.FromInterface(queued)
+	}
+
+	if alert.Kind != "discord" && alert.Kind != "slack" && alert.Kind != "http" {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "type",
+			Expected: "discord, slack or http",
+			Found:    alert.Kind,
+		}
+	}
+
+	if alert.URL == "" || alert.Message == "" {
+		return nil, fmt.Errorf("notify: url and message are required")
+	}
+
+	if o.dispatcher.Enqueue(alert) {
+		return tengo.TrueValue, nil
+	}
+
+	return tengo.FalseValue, nil
+}
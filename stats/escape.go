@@ -1,8 +1,6 @@
 package stats
 
 import (
-	"strings"
-
 	"github.com/d5/tengo/v2"
 )
 
@@ -21,7 +19,8 @@ func (o *TengoTagEscape) String() string {
 	return "tagescape"
 }
 
-// Call provides the escape functionality.
+// Call provides the escape functionality. Escapes backslashes, commas, spaces
+// and equals signs, and newlines which can't appear in a tag at all.
 func (o *TengoTagEscape) Call(args ...tengo.Object) (ret tengo.Object, err error) {
 	if len(args) != 1 {
 		return nil, tengo.ErrWrongNumArguments
@@ -36,11 +35,7 @@ func (o *TengoTagEscape) Call(args ...tengo.Object) (ret tengo.Object, err error
 		}
 	}
 
-	s1 = strings.ReplaceAll(s1, ",", "\\,")
-	s1 = strings.ReplaceAll(s1, " ", "\\ ")
-	s1 = strings.ReplaceAll(s1, "=", "\\=")
-
-	return &tengo.String{Value: s1}, nil
+	return &tengo.String{Value: escapeTag(s1)}, nil
 }
 
 // CanCall returns true since we're a function type.
@@ -58,7 +53,8 @@ func (o *TengoFieldEscape) String() string {
 	return "fieldescape"
 }
 
-// Call provides the field escape functionality.
+// Call provides the field escape functionality, for string field values.
+// Escapes backslashes and double quotes.
 func (o *TengoFieldEscape) Call(args ...tengo.Object) (ret tengo.Object, err error) {
 	if len(args) != 1 {
 		return nil, tengo.ErrWrongNumArguments
@@ -73,7 +69,5 @@ func (o *TengoFieldEscape) Call(args ...tengo.Object) (ret tengo.Object, err err
 		}
 	}
 
-	s1 = strings.ReplaceAll(s1, "\\", "\\\\")
-
-	return &tengo.String{Value: s1}, nil
+	return &tengo.String{Value: escapeFieldString(s1)}, nil
 }
@@ -0,0 +1,144 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// FileSink writes points to a rotating local file, either as one JSON object
+// per line (jsonl), or as CSV with one row per field (csv). Every record
+// includes the server tag, and points without a timestamp are given the time
+// they were written.
+type FileSink struct {
+	Tag    string
+	Format string
+	File   *RotatingFile
+}
+
+// CSVHeader is the header row written at the start of every CSV file.
+const CSVHeader = "time,servertag,bucket,measurement,tags,field,value\n"
+
+// Name returns the sink name
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+// Write appends the points to the file.
+func (s *FileSink) Write(bucket string, points []*Point) error {
+	var b bytes.Buffer
+	now := time.Now()
+
+	switch s.Format {
+	case "", "jsonl":
+		for _, p := range points {
+			r := newPointRecord(bucket, p)
+			r.Tag = s.Tag
+			if r.Time == 0 {
+				r.Time = now.UnixNano()
+			}
+
+			data, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			b.Write(data)
+			b.WriteString("\n")
+		}
+	case "csv":
+		w := csv.NewWriter(&b)
+		for _, p := range points {
+			if err := w.WriteAll(csvRows(s.Tag, bucket, p, now)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown file format %s, must be one of jsonl or csv", s.Format)
+	}
+
+	_, err := s.File.Write(b.Bytes())
+
+	return err
+}
+
+// csvRows returns a row for each field of the point, with the tags encoded
+// as a line protocol tag set.
+func csvRows(tag string, bucket string, p *Point, now time.Time) [][]string {
+	ts := p.Time
+	if ts.IsZero() {
+		ts = now
+	}
+
+	keys := make([]string, 0, len(p.Tags))
+	for k := range p.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tags := make([]string, 0, len(keys))
+	for _, k := range keys {
+		tags = append(tags, escapeTag(k)+"="+escapeTag(p.Tags[k]))
+	}
+
+	fields := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+
+	rows := make([][]string, 0, len(fields))
+	for _, k := range fields {
+		var value string
+		switch v := p.Fields[k].(type) {
+		case int64:
+			value = strconv.FormatInt(v, 10)
+		case float64:
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			value = fmt.Sprintf("%v", v)
+		}
+
+		rows = append(rows, []string{
+			ts.UTC().Format(time.RFC3339Nano), tag, bucket, p.Name, strings.Join(tags, ","), k, value})
+	}
+
+	return rows
+}
+
+// MessageLog writes every raw RCON message to a rotating local file, as one
+// JSON object per line.
+type MessageLog struct {
+	Tag  string
+	File *RotatingFile
+}
+
+type messageRecord struct {
+	Time    int64           `json:"time"`
+	Tag     string          `json:"tag"`
+	Message json.RawMessage `json:"message"`
+}
+
+// OnMessage logs a single message, suitable for use as an RCON callback.
+func (l *MessageLog) OnMessage(message []byte) {
+	r := messageRecord{Time: time.Now().UnixNano(), Tag: l.Tag, Message: message}
+	if !json.Valid(message) {
+		r.Message, _ = json.Marshal(string(message))
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		zap.S().Errorf("Error encoding RCON message for %s: %s", l.File.Path, err)
+		return
+	}
+
+	if _, err := l.File.Write(append(data, '\n')); err != nil {
+		zap.S().Errorf("Error writing RCON message to %s: %s", l.File.Path, err)
+	}
+}
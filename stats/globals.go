@@ -2,23 +2,80 @@ package stats
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/d5/tengo/v2"
 )
 
-var globalsValue map[string]tengo.Object = make(map[string]tengo.Object)
+// globalEntry holds a single _GLOBALS value along with its expiration time, if
+// any. An expires of 0 means the key never expires.
+type globalEntry struct {
+	value   tengo.Object
+	expires int64
+}
+
+var globalsValue map[string]*globalEntry = make(map[string]*globalEntry)
 var globalsLock sync.Mutex
 
+func (e *globalEntry) expired(now int64) bool {
+	return e.expires > 0 && now >= e.expires
+}
+
+// getGlobal returns the value of a key, expiring it first if needed. The
+// caller must hold globalsLock.
+func getGlobal(key string) (tengo.Object, bool) {
+	entry, ok := globalsValue[key]
+	if !ok {
+		return nil, false
+	}
+
+	if entry.expired(time.Now().Unix()) {
+		delete(globalsValue, key)
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+// setGlobal sets the value of a key, keeping any existing expiration. The
+// caller must hold globalsLock.
+func setGlobal(key string, value tengo.Object) {
+	if entry, ok := globalsValue[key]; ok && !entry.expired(time.Now().Unix()) {
+		entry.value = value
+		return
+	}
+
+	globalsValue[key] = &globalEntry{value: value}
+}
+
+// expireGlobals removes every expired key.
+func expireGlobals() {
+	globalsLock.Lock()
+	defer globalsLock.Unlock()
+
+	now := time.Now().Unix()
+	for k, v := range globalsValue {
+		if v.expired(now) {
+			delete(globalsValue, k)
+		}
+	}
+}
+
 // String returns a string representation
 func (o *TengoGlobals) String() string {
 	globalsLock.Lock()
 	defer globalsLock.Unlock()
 
 	var elements []string
+	now := time.Now().Unix()
 	for _, e := range globalsValue {
-		elements = append(elements, e.String())
+		if e.expired(now) {
+			continue
+		}
+		elements = append(elements, e.value.String())
 	}
 	return fmt.Sprintf("[%s]", strings.Join(elements, ", "))
 }
@@ -38,7 +95,7 @@ func (o *TengoGlobals) IndexGet(index tengo.Object) (res tengo.Object, err error
 		err = tengo.ErrInvalidIndexType
 		return
 	}
-	res, ok = globalsValue[strIdx]
+	res, ok = getGlobal(strIdx)
 	if !ok {
 		res = tengo.UndefinedValue
 	}
@@ -55,6 +112,196 @@ func (o *TengoGlobals) IndexSet(index, value tengo.Object) (err error) {
 		err = tengo.ErrInvalidIndexType
 		return
 	}
-	globalsValue[strIdx] = value
+	setGlobal(strIdx, value)
 	return nil
 }
+
+// CanCall returns true since we're a function type.
+func (o *TengoGlobalsKeys) CanCall() bool {
+	return true
+}
+
+// TypeName returns the function name
+func (o *TengoGlobalsKeys) TypeName() string {
+	return "globals_keys"
+}
+
+// String returns the function name
+func (o *TengoGlobalsKeys) String() string {
+	return "globals_keys"
+}
+
+// Call returns a sorted array of every key currently in _GLOBALS.
+// globals_keys()
+func (o *TengoGlobalsKeys) Call(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) > 0 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+
+	globalsLock.Lock()
+	defer globalsLock.Unlock()
+
+	var keys []string
+	now := time.Now().Unix()
+	for k, v := range globalsValue {
+		if v.expired(now) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	arr := &tengo.Array{}
+	for _, k := range keys {
+		arr.Value = append(arr.Value, &tengo.String{Value: k})
+	}
+
+	return arr, nil
+}
+
+// CanCall returns true since we're a function type.
+func (o *TengoGlobalsDelete) CanCall() bool {
+	return true
+}
+
+// TypeName returns the function name
+func (o *TengoGlobalsDelete) TypeName() string {
+	return "globals_delete"
+}
+
+// String returns the function name
+func (o *TengoGlobalsDelete) String() string {
+	return "globals_delete"
+}
+
+// Call deletes a key from _GLOBALS, returning true if it existed.
+// globals_delete(key)
+func (o *TengoGlobalsDelete) Call(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 1 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+
+	key, ok := tengo.ToString(args[0])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "first",
+			Expected: "string",
+			Found:    args[0].TypeName(),
+		}
+	}
+
+	globalsLock.Lock()
+	defer globalsLock.Unlock()
+
+	if _, ok := getGlobal(key); !ok {
+		return tengo.FalseValue, nil
+	}
+
+	delete(globalsValue, key)
+	return tengo.TrueValue, nil
+}
+
+// CanCall returns true since we're a function type.
+func (o *TengoGlobalsExpire) CanCall() bool {
+	return true
+}
+
+// TypeName returns the function name
+func (o *TengoGlobalsExpire) TypeName() string {
+	return "globals_expire"
+}
+
+// String returns the function name
+func (o *TengoGlobalsExpire) String() string {
+	return "globals_expire"
+}
+
+// Call sets a key to expire after the given number of seconds. A value of 0
+// or less removes any existing expiration. Returns false if the key doesn't
+// exist.
+// globals_expire(key, seconds)
+func (o *TengoGlobalsExpire) Call(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 2 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+
+	key, ok := tengo.ToString(args[0])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "first",
+			Expected: "string",
+			Found:    args[0].TypeName(),
+		}
+	}
+
+	seconds, ok := tengo.ToInt64(args[1])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "second",
+			Expected: "int",
+			Found:    args[1].TypeName(),
+		}
+	}
+
+	globalsLock.Lock()
+	defer globalsLock.Unlock()
+
+	if _, ok := getGlobal(key); !ok {
+		return tengo.FalseValue, nil
+	}
+
+	if seconds > 0 {
+		globalsValue[key].expires = time.Now().Unix() + seconds
+	} else {
+		globalsValue[key].expires = 0
+	}
+
+	return tengo.TrueValue, nil
+}
+
+// CanCall returns true since we're a function type.
+func (o *TengoGlobalsTTL) CanCall() bool {
+	return true
+}
+
+// TypeName returns the function name
+func (o *TengoGlobalsTTL) TypeName() string {
+	return "globals_ttl"
+}
+
+// String returns the function name
+func (o *TengoGlobalsTTL) String() string {
+	return "globals_ttl"
+}
+
+// Call returns the remaining seconds before a key expires. Like redis, -1
+// means the key has no expiration and -2 means the key doesn't exist.
+// globals_ttl(key)
+func (o *TengoGlobalsTTL) Call(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 1 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+
+	key, ok := tengo.ToString(args[0])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "first",
+			Expected: "string",
+			Found:    args[0].TypeName(),
+		}
+	}
+
+	globalsLock.Lock()
+	defer globalsLock.Unlock()
+
+	if _, ok := getGlobal(key); !ok {
+		return &tengo.Int{Value: -2}, nil
+	}
+
+	entry := globalsValue[key]
+	if entry.expires == 0 {
+		return &tengo.Int{Value: -1}, nil
+	}
+
+	return &tengo.Int{Value: entry.expires - time.Now().Unix()}, nil
+}
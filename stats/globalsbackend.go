@@ -0,0 +1,382 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/gomodule/redigo/redis"
+	"go.uber.org/zap"
+)
+
+// GlobalsBackend persists the contents of _GLOBALS between restarts.
+type GlobalsBackend interface {
+	Load() (map[string]PersistedGlobal, error)
+	Save(map[string]PersistedGlobal) error
+}
+
+// PersistedGlobal is the stored form of a single _GLOBALS key. Expires is a
+// unix timestamp, or 0 if the key never expires.
+type PersistedGlobal struct {
+	Value   json.RawMessage `json:"value"`
+	Expires int64           `json:"expires,omitempty"`
+}
+
+// FileGlobalsBackend stores _GLOBALS as a JSON snapshot on local disk.
+type FileGlobalsBackend struct {
+	Path string
+}
+
+// RedisGlobalsBackend stores _GLOBALS in a redis hash, one field per key.
+type RedisGlobalsBackend struct {
+	Pool *redis.Pool
+	Key  string
+}
+
+// Tengo objects are stored with their type alongside the value, otherwise
+// ints come back as floats and the scripts doing math on them get confused.
+type encodedObject struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func encodeObject(o tengo.Object) ([]byte, error) {
+	var t string
+	var v interface{}
+
+	switch o := o.(type) {
+	case *tengo.Int:
+		t, v = "int", o.Value
+	case *tengo.Float:
+		t, v = "float", o.Value
+	case *tengo.String:
+		t, v = "string", o.Value
+	case *tengo.Bool:
+		t, v = "bool", !o.IsFalsy()
+	case *tengo.Char:
+		t, v = "char", string(o.Value)
+	case *tengo.Bytes:
+		t, v = "bytes", o.Value
+	case *tengo.Time:
+		t, v = "time", o.Value.Format(time.RFC3339Nano)
+	case *tengo.Undefined:
+		t = "undefined"
+	case *tengo.Array:
+		return encodeArray("array", o.Value)
+	case *tengo.ImmutableArray:
+		return encodeArray("immutable-array", o.Value)
+	case *tengo.Map:
+		return encodeMap("map", o.Value)
+	case *tengo.ImmutableMap:
+		return encodeMap("immutable-map", o.Value)
+	default:
+		return nil, fmt.Errorf("unable to persist value of type %s", o.TypeName())
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if t == "undefined" {
+		raw = nil
+	}
+
+	return json.Marshal(encodedObject{Type: t, Value: raw})
+}
+
+func encodeArray(t string, values []tengo.Object) ([]byte, error) {
+	elements := make([]json.RawMessage, 0, len(values))
+	for _, v := range values {
+		e, err := encodeObject(v)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, e)
+	}
+
+	raw, err := json.Marshal(elements)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(encodedObject{Type: t, Value: raw})
+}
+
+func encodeMap(t string, values map[string]tengo.Object) ([]byte, error) {
+	elements := make(map[string]json.RawMessage, len(values))
+	for k, v := range values {
+		e, err := encodeObject(v)
+		if err != nil {
+			return nil, err
+		}
+		elements[k] = e
+	}
+
+	raw, err := json.Marshal(elements)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(encodedObject{Type: t, Value: raw})
+}
+
+func decodeObject(data []byte) (tengo.Object, error) {
+	var e encodedObject
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+
+	switch e.Type {
+	case "int":
+		var v int64
+		err := json.Unmarshal(e.Value, &v)
+		return &tengo.Int{Value: v}, err
+	case "float":
+		var v float64
+		err := json.Unmarshal(e.Value, &v)
+		return &tengo.Float{Value: v}, err
+	case "string":
+		var v string
+		err := json.Unmarshal(e.Value, &v)
+		return &tengo.String{Value: v}, err
+	case "bool":
+		var v bool
+		err := json.Unmarshal(e.Value, &v)
+		if v {
+			return tengo.TrueValue, err
+		}
+		return tengo.FalseValue, err
+	case "char":
+		var v string
+		err := json.Unmarshal(e.Value, &v)
+		if err != nil || len([]rune(v)) != 1 {
+			return nil, fmt.Errorf("invalid char value %s", e.Value)
+		}
+		return &tengo.Char{Value: []rune(v)[0]}, nil
+	case "bytes":
+		var v []byte
+		err := json.Unmarshal(e.Value, &v)
+		return &tengo.Bytes{Value: v}, err
+	case "time":
+		var v string
+		if err := json.Unmarshal(e.Value, &v); err != nil {
+			return nil, err
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return &tengo.Time{Value: t}, err
+	case "undefined":
+		return tengo.UndefinedValue, nil
+	case "array", "immutable-array":
+		var raw []json.RawMessage
+		if err := json.Unmarshal(e.Value, &raw); err != nil {
+			return nil, err
+		}
+		values := make([]tengo.Object, 0, len(raw))
+		for _, r := range raw {
+			v, err := decodeObject(r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		if e.Type == "immutable-array" {
+			return &tengo.ImmutableArray{Value: values}, nil
+		}
+		return &tengo.Array{Value: values}, nil
+	case "map", "immutable-map":
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(e.Value, &raw); err != nil {
+			return nil, err
+		}
+		values := make(map[string]tengo.Object, len(raw))
+		for k, r := range raw {
+			v, err := decodeObject(r)
+			if err != nil {
+				return nil, err
+			}
+			values[k] = v
+		}
+		if e.Type == "immutable-map" {
+			return &tengo.ImmutableMap{Value: values}, nil
+		}
+		return &tengo.Map{Value: values}, nil
+	}
+
+	return nil, fmt.Errorf("unknown persisted type %s", e.Type)
+}
+
+// Load reads the snapshot file. A missing file isn't an error, it just means
+// we haven't flushed yet.
+func (b *FileGlobalsBackend) Load() (map[string]PersistedGlobal, error) {
+	data, err := ioutil.ReadFile(b.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	globals := make(map[string]PersistedGlobal)
+	if err := json.Unmarshal(data, &globals); err != nil {
+		return nil, err
+	}
+
+	return globals, nil
+}
+
+// Save writes the snapshot to a temp file first and renames it into place, so
+// a crash mid-write doesn't clobber the last good snapshot.
+func (b *FileGlobalsBackend) Save(globals map[string]PersistedGlobal) error {
+	data, err := json.Marshal(globals)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(b.Path), filepath.Base(b.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), b.Path)
+}
+
+// Load reads every field of the redis hash.
+func (b *RedisGlobalsBackend) Load() (map[string]PersistedGlobal, error) {
+	conn := b.Pool.Get()
+	defer conn.Close()
+
+	fields, err := redis.StringMap(conn.Do("HGETALL", b.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	globals := make(map[string]PersistedGlobal)
+	for k, v := range fields {
+		var g PersistedGlobal
+		if err := json.Unmarshal([]byte(v), &g); err != nil {
+			zap.S().Errorf("Skipping persisted global %s, unable to decode: %s", k, err)
+			continue
+		}
+		globals[k] = g
+	}
+
+	return globals, nil
+}
+
+// Save replaces the redis hash with the current snapshot.
+func (b *RedisGlobalsBackend) Save(globals map[string]PersistedGlobal) error {
+	conn := b.Pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("DEL", b.Key)
+	for k, v := range globals {
+		data, err := json.Marshal(v)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+		conn.Send("HSET", b.Key, k, data)
+	}
+	_, err := conn.Do("EXEC")
+
+	return err
+}
+
+// LoadGlobals populates _GLOBALS from the backend. Expired keys are dropped.
+func LoadGlobals(backend GlobalsBackend) error {
+	persisted, err := backend.Load()
+	if err != nil {
+		return err
+	}
+
+	globalsLock.Lock()
+	defer globalsLock.Unlock()
+
+	now := time.Now().Unix()
+	for k, v := range persisted {
+		entry := &globalEntry{expires: v.Expires}
+		if entry.expired(now) {
+			continue
+		}
+
+		entry.value, err = decodeObject(v.Value)
+		if err != nil {
+			zap.S().Errorf("Skipping persisted global %s, unable to decode: %s", k, err)
+			continue
+		}
+
+		globalsValue[k] = entry
+	}
+
+	zap.S().Infof("Loaded %d persisted globals.", len(globalsValue))
+
+	return nil
+}
+
+// SaveGlobals writes a snapshot of _GLOBALS to the backend. Values that can't
+// be persisted (functions, etc.) are skipped.
+func SaveGlobals(backend GlobalsBackend) error {
+	expireGlobals()
+
+	globalsLock.Lock()
+	persisted := make(map[string]PersistedGlobal, len(globalsValue))
+	for k, v := range globalsValue {
+		data, err := encodeObject(v.value)
+		if err != nil {
+			zap.S().Warnf("Not persisting global %s: %s", k, err)
+			continue
+		}
+		persisted[k] = PersistedGlobal{Value: data, Expires: v.expires}
+	}
+	globalsLock.Unlock()
+
+	return backend.Save(persisted)
+}
+
+// MaintainGlobals periodically flushes _GLOBALS to the backend, and once more
+// on shutdown.
+func MaintainGlobals(backend GlobalsBackend, interval int, done chan struct{}, wg *sync.WaitGroup) {
+	zap.S().Info("Starting up globals persistence.")
+	wg.Add(1)
+
+	if interval <= 0 {
+		interval = 60
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			zap.S().Info("Flushing globals and shutting down globals persistence.")
+			if err := SaveGlobals(backend); err != nil {
+				zap.S().Errorf("Error flushing globals: %s", err)
+			}
+			wg.Done()
+			return
+		case <-ticker.C:
+			if err := SaveGlobals(backend); err != nil {
+				zap.S().Errorf("Error flushing globals: %s", err)
+			}
+		}
+	}
+}
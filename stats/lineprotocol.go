@@ -0,0 +1,315 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Point is a single parsed measurement.
+type Point struct {
+	Name   string
+	Tags   map[string]string
+	Fields map[string]interface{}
+	Time   time.Time
+}
+
+// SeriesKey returns the measurement and sorted tag set, identifying the series
+// the point belongs to.
+func (p *Point) SeriesKey() string {
+	keys := make([]string, 0, len(p.Tags))
+	for k := range p.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(p.Name)
+	for _, k := range keys {
+		b.WriteString(",")
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(p.Tags[k])
+	}
+
+	return b.String()
+}
+
+var (
+	measurementEscaper = strings.NewReplacer("\\", "\\\\", ",", "\\,", " ", "\\ ", "\n", "\\n", "\r", "\\r")
+	tagEscaper         = strings.NewReplacer("\\", "\\\\", ",", "\\,", " ", "\\ ", "=", "\\=", "\n", "\\n", "\r", "\\r")
+	fieldStringEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
+)
+
+func escapeTag(s string) string {
+	return tagEscaper.Replace(s)
+}
+
+func escapeFieldString(s string) string {
+	return fieldStringEscaper.Replace(s)
+}
+
+// formatFieldValue formats a field value with the line protocol type suffix
+// or quoting it needs.
+func formatFieldValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", nil
+	case int:
+		return strconv.Itoa(v) + "i", nil
+	case uint64:
+		return strconv.FormatUint(v, 10) + "u", nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case string:
+		return "\"" + escapeFieldString(v) + "\"", nil
+	}
+
+	return "", fmt.Errorf("unsupported field type %T", v)
+}
+
+// LineProtocol encodes the point as a single line of InfluxDB line protocol.
+// Tags and fields are sorted so the same point always encodes the same way.
+func (p *Point) LineProtocol() (string, error) {
+	if p.Name == "" {
+		return "", fmt.Errorf("missing measurement name")
+	}
+
+	if len(p.Fields) == 0 {
+		return "", fmt.Errorf("%s: at least one field is required", p.Name)
+	}
+
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(p.Name))
+
+	tags := make([]string, 0, len(p.Tags))
+	for k := range p.Tags {
+		tags = append(tags, k)
+	}
+	sort.Strings(tags)
+
+	for _, k := range tags {
+		// Empty tag values aren't allowed, a missing tag means the same thing.
+		if p.Tags[k] == "" {
+			continue
+		}
+		b.WriteString(",")
+		b.WriteString(escapeTag(k))
+		b.WriteString("=")
+		b.WriteString(escapeTag(p.Tags[k]))
+	}
+
+	fields := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+
+	for i, k := range fields {
+		v, err := formatFieldValue(p.Fields[k])
+		if err != nil {
+			return "", fmt.Errorf("%s: field %s: %s", p.Name, k, err)
+		}
+
+		if i == 0 {
+			b.WriteString(" ")
+		} else {
+			b.WriteString(",")
+		}
+		b.WriteString(escapeTag(k))
+		b.WriteString("=")
+		b.WriteString(v)
+	}
+
+	if !p.Time.IsZero() {
+		b.WriteString(" ")
+		b.WriteString(strconv.FormatInt(p.Time.UnixNano(), 10))
+	}
+
+	return b.String(), nil
+}
+
+// FieldFloat returns a numeric or bool field as a float64.
+func (p *Point) FieldFloat(field string) (float64, bool) {
+	switch v := p.Fields[field].(type) {
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// indexUnescaped returns the index of the first sep in s not preceded by a
+// backslash, and if quotes is set, not inside a double quoted string.
+func indexUnescaped(s string, sep byte, quotes bool) int {
+	inQuote := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			inQuote = !inQuote
+		case !inQuote && s[i] == sep:
+			return i
+		}
+	}
+
+	return -1
+}
+
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var parts []string
+	for {
+		i := indexUnescaped(s, sep, quotes)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+// unescape removes the escaping from a measurement, tag or field key, or if
+// field is set, a string field value. Newlines can't appear raw in a line, so
+// only names and tags escape them as \n and \r, while string field values
+// keep a backslash followed by n as it is.
+func unescape(s string, field bool) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch c := s[i+1]; {
+			case c == ',', c == '=', c == ' ', c == '"', c == '\\':
+				i++
+			case c == 'n' && !field:
+				b.WriteByte('\n')
+				i++
+				continue
+			case c == 'r' && !field:
+				b.WriteByte('\r')
+				i++
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+func parseFieldValue(v string) (interface{}, error) {
+	if v == "" {
+		return nil, fmt.Errorf("missing field value")
+	}
+
+	if v[0] == '"' {
+		if len(v) < 2 || v[len(v)-1] != '"' || indexUnescaped(v[1:len(v)-1], '"', false) >= 0 {
+			return nil, fmt.Errorf("unterminated string field value %s", v)
+		}
+		return unescape(v[1:len(v)-1], true), nil
+	}
+
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+
+	switch v[len(v)-1] {
+	case 'i':
+		return strconv.ParseInt(v[:len(v)-1], 10, 64)
+	case 'u':
+		return strconv.ParseUint(v[:len(v)-1], 10, 64)
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid field value %s", v)
+	}
+
+	return f, nil
+}
+
+// parseLine parses a single line of InfluxDB line protocol.
+func parseLine(line string) (*Point, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.TrimSpace(line) == "" {
+		return nil, fmt.Errorf("empty line")
+	}
+
+	i := indexUnescaped(line, ' ', false)
+	if i < 0 {
+		return nil, fmt.Errorf("missing fields")
+	}
+	series, rest := line[:i], line[i+1:]
+
+	p := &Point{
+		Tags:   make(map[string]string),
+		Fields: make(map[string]interface{}),
+	}
+
+	parts := splitUnescaped(series, ',', false)
+	p.Name = unescape(parts[0], false)
+	if p.Name == "" {
+		return nil, fmt.Errorf("missing measurement name")
+	}
+
+	for _, tag := range parts[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid tag %s", tag)
+		}
+		p.Tags[unescape(kv[0], false)] = unescape(kv[1], false)
+	}
+
+	var fields, timestamp string
+	if i := indexUnescaped(rest, ' ', true); i >= 0 {
+		fields, timestamp = rest[:i], strings.TrimSpace(rest[i+1:])
+	} else {
+		fields = rest
+	}
+
+	if fields == "" {
+		return nil, fmt.Errorf("missing fields")
+	}
+
+	for _, field := range splitUnescaped(fields, ',', true) {
+		eq := indexUnescaped(field, '=', true)
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid field %s", field)
+		}
+
+		v, err := parseFieldValue(field[eq+1:])
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", unescape(field[:eq], false), err)
+		}
+		p.Fields[unescape(field[:eq], false)] = v
+	}
+
+	if timestamp != "" {
+		ns, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %s", timestamp)
+		}
+		p.Time = time.Unix(0, ns)
+	}
+
+	return p, nil
+}
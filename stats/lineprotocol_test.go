@@ -0,0 +1,123 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLineProtocolRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		point *Point
+		want  string
+	}{
+		{"float", &Point{
+			Name:   "serverfps",
+			Tags:   map[string]string{},
+			Fields: map[string]interface{}{"fps": 59.5},
+		}, "serverfps fps=59.5"},
+		{"field types", &Point{
+			Name: "serverinfo",
+			Tags: map[string]string{"server": "eu-1"},
+			Fields: map[string]interface{}{
+				"players":  int64(-3),
+				"entities": uint64(254321),
+				"online":   true,
+				"wiped":    false,
+				"map":      "Procedural Map",
+			},
+			Time: time.Unix(0, 1792336931000000000),
+		}, `serverinfo,server=eu-1 entities=254321u,map="Procedural Map",online=true,players=-3i,wiped=false 1792336931000000000`},
+		{"sorted tags", &Point{
+			Name:   "playerping",
+			Tags:   map[string]string{"steamid": "76561198012345678", "name": "Bob"},
+			Fields: map[string]interface{}{"ping": int64(32)},
+		}, "playerping,name=Bob,steamid=76561198012345678 ping=32i"},
+		{"spaces", &Point{
+			Name:   "player ping",
+			Tags:   map[string]string{"display name": "Big Al the Builder"},
+			Fields: map[string]interface{}{"ping ms": int64(118), "note": "a b  c "},
+		}, `player\ ping,display\ name=Big\ Al\ the\ Builder note="a b  c ",ping\ ms=118i`},
+		{"commas", &Point{
+			Name:   "a,b",
+			Tags:   map[string]string{"k,1": "v,1"},
+			Fields: map[string]interface{}{"f,1": "x,y"},
+		}, `a\,b,k\,1=v\,1 f\,1="x,y"`},
+		{"equals", &Point{
+			Name:   "a=b",
+			Tags:   map[string]string{"k=1": "v=1"},
+			Fields: map[string]interface{}{"f=1": "x=y"},
+		}, `a=b,k\=1=v\=1 f\=1="x=y"`},
+		{"backslashes", &Point{
+			Name:   `C:\rust`,
+			Tags:   map[string]string{`dir\`: `C:\rust\`},
+			Fields: map[string]interface{}{`f\`: `C:\rust\`},
+		}, `C:\\rust,dir\\=C:\\rust\\ f\\="C:\\rust\\"`},
+		{"newlines", &Point{
+			Name:   "chat\nlog",
+			Tags:   map[string]string{"name": "Bob\r\n"},
+			Fields: map[string]interface{}{"message": "hello\nworld", "raw": `\n`},
+		}, "chat\\nlog,name=Bob\\r\\n message=\"hello\nworld\",raw=\"\\\\n\""},
+		{"quotes", &Point{
+			Name:   `say"hi"`,
+			Tags:   map[string]string{"name": `Mr "Quotes" McGee`},
+			Fields: map[string]interface{}{"message": `he said "hi", then "bye"`},
+		}, `say"hi",name=Mr\ "Quotes"\ McGee message="he said \"hi\", then \"bye\""`},
+		{"empty string field", &Point{
+			Name:   "m",
+			Tags:   map[string]string{},
+			Fields: map[string]interface{}{"s": ""},
+		}, `m s=""`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line, err := test.point.LineProtocol()
+			if err != nil {
+				t.Fatalf("LineProtocol() returned an error: %s", err)
+			}
+
+			if line != test.want {
+				t.Errorf("LineProtocol() =\n%s\nwant\n%s", line, test.want)
+			}
+
+			got, err := parseLine(line)
+			if err != nil {
+				t.Fatalf("parseLine(%q) returned an error: %s", line, err)
+			}
+
+			if !reflect.DeepEqual(got, test.point) {
+				t.Errorf("parseLine(%q) =\n%#v\nwant\n%#v", line, got, test.point)
+			}
+		})
+	}
+}
+
+func TestParseLineMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"empty", ""},
+		{"missing fields", "serverfps"},
+		{"missing measurement", ",server=eu-1 fps=60"},
+		{"empty tag value", "serverfps,server= fps=60"},
+		{"tag without value", "serverfps,server fps=60"},
+		{"field without value", "serverfps fps="},
+		{"field without key", "serverfps =60"},
+		{"bad float", "serverfps fps=sixty"},
+		{"bad integer", "serverfps fps=60.5i"},
+		{"negative unsigned", "serverfps fps=-60u"},
+		{"unterminated string", `serverfps note="sixty`},
+		{"bad timestamp", "serverfps fps=60 yesterday"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if p, err := parseLine(test.line); err == nil {
+				t.Errorf("parseLine(%q) = %#v, want an error", test.line, p)
+			}
+		})
+	}
+}
@@ -1,12 +1,184 @@
 package stats
 
 import (
+	"fmt"
 	"sync"
 
 	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/parser"
+	"github.com/d5/tengo/v2/token"
+	"go.uber.org/zap"
 )
 
-var tengoLock sync.Mutex
+// withLockSource builds with_lock(). Tengo has no way to call a script
+// function from Go, so with_lock() is a tengo closure over a run's lock and
+// unlock instead. It only uses its parameters, locals and the captured
+// functions, never the constants or globals of the script that built it, so
+// it can be called from any script. If fn errors out the script stops, and
+// the held lock is released by releaseAll() after the run.
+const withLockSource = `
+with_lock := func(lock, unlock) {
+	return func(name, fn) {
+		lock(name)
+		r := fn()
+		unlock(name)
+		return r
+	}
+}(lock, unlock)
+`
+
+var withLockCompiled = compileWithLock()
+
+func compileWithLock() *tengo.Compiled {
+	script := tengo.NewScript([]byte(withLockSource))
+	_ = script.Add("lock", nil)
+	_ = script.Add("unlock", nil)
+
+	compiled, err := script.Compile()
+	if err != nil {
+		panic(err)
+	}
+
+	return compiled
+}
+
+// newWithLock returns with_lock() for a single script run.
+func newWithLock(locks *scriptLocks) (tengo.Object, error) {
+	compiled := withLockCompiled.Clone()
+	_ = compiled.Set("lock", &TengoLock{locks: locks})
+	_ = compiled.Set("unlock", &TengoUnlock{locks: locks})
+
+	if err := compiled.Run(); err != nil {
+		return nil, err
+	}
+
+	return compiled.Get("with_lock").Object(), nil
+}
+
+// declaresGlobal returns whether a script declares name at the top level, so
+// a script with its own with_lock() doesn't clash with ours.
+func declaresGlobal(src []byte, name string) bool {
+	fileSet := parser.NewFileSet()
+	file, err := parser.NewParser(fileSet.AddFile("(main)", -1, len(src)), src, nil).ParseFile()
+	if err != nil {
+		// The script won't compile anyway, and says why.
+		return false
+	}
+
+	for _, stmt := range file.Stmts {
+		assign, ok := stmt.(*parser.AssignStmt)
+		if !ok || assign.Token != token.Define {
+			continue
+		}
+
+		for _, lhs := range assign.LHS {
+			if ident, ok := lhs.(*parser.Ident); ok && ident.Name == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Named locks are channels with a buffer of one rather than sync.Mutex, so
+// unlocking a lock that isn't held can be detected instead of panicking.
+var namedLocks map[string]chan struct{} = make(map[string]chan struct{})
+var namedLocksMu sync.Mutex
+
+func getNamedLock(name string) chan struct{} {
+	namedLocksMu.Lock()
+	defer namedLocksMu.Unlock()
+
+	l, ok := namedLocks[name]
+	if !ok {
+		l = make(chan struct{}, 1)
+		namedLocks[name] = l
+	}
+
+	return l
+}
+
+// scriptLocks tracks the locks held by a single script run, so they can be
+// released if the script exits without unlocking them.
+type scriptLocks struct {
+	script string
+	mu     sync.Mutex
+	held   map[string]bool
+}
+
+func newScriptLocks(script string) *scriptLocks {
+	return &scriptLocks{script: script, held: make(map[string]bool)}
+}
+
+func (s *scriptLocks) lock(name string) error {
+	s.mu.Lock()
+	if s.held[name] {
+		s.mu.Unlock()
+		return fmt.Errorf("lock %s is already held by this script", name)
+	}
+	s.mu.Unlock()
+
+	getNamedLock(name) <- struct{}{}
+
+	s.mu.Lock()
+	s.held[name] = true
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *scriptLocks) unlock(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.held[name] {
+		return fmt.Errorf("lock %s is not held by this script", name)
+	}
+
+	<-getNamedLock(name)
+	delete(s.held, name)
+
+	return nil
+}
+
+func (s *scriptLocks) releaseAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name := range s.held {
+		zap.S().Warnf("Script %s exited while holding lock %s, releasing it.", s.script, name)
+		<-getNamedLock(name)
+		delete(s.held, name)
+	}
+}
+
+// defaultLockName is the lock used by lock() and unlock() without a name,
+// shared across all scripts.
+const defaultLockName = "global"
+
+// lockName returns the lock name from the arguments, or the shared default
+// if none was given.
+func (s *scriptLocks) lockName(args ...tengo.Object) (string, error) {
+	if len(args) > 1 {
+		return "", tengo.ErrWrongNumArguments
+	}
+
+	if len(args) == 0 {
+		return defaultLockName, nil
+	}
+
+	name, ok := tengo.ToString(args[0])
+	if !ok {
+		return "", tengo.ErrInvalidArgumentType{
+			Name:     "first",
+			Expected: "string",
+			Found:    args[0].TypeName(),
+		}
+	}
+
+	return name, nil
+}
 
 // CanCall returns true since we're a function type.
 func (o *TengoLock) CanCall() bool {
@@ -24,12 +196,16 @@ func (o *TengoLock) String() string {
 }
 
 // Call provides the lock functionality.
+// lock([optional]name)
 func (o *TengoLock) Call(args ...tengo.Object) (ret tengo.Object, err error) {
-	if len(args) > 0 {
-		return nil, tengo.ErrWrongNumArguments
+	name, err := o.locks.lockName(args...)
+	if err != nil {
+		return nil, err
 	}
 
-	tengoLock.Lock()
+	if err := o.locks.lock(name); err != nil {
+		return nil, err
+	}
 
 	return tengo.UndefinedValue, nil
 }
@@ -49,13 +225,17 @@ func (o *TengoUnlock) String() string {
 	return "unlock"
 }
 
-// Call provides the lock functionality.
+// Call provides the unlock functionality.
+// unlock([optional]name)
 func (o *TengoUnlock) Call(args ...tengo.Object) (ret tengo.Object, err error) {
-	if len(args) > 0 {
-		return nil, tengo.ErrWrongNumArguments
+	name, err := o.locks.lockName(args...)
+	if err != nil {
+		return nil, err
 	}
 
-	tengoLock.Unlock()
+	if err := o.locks.unlock(name); err != nil {
+		return nil, err
+	}
 
 	return tengo.UndefinedValue, nil
 }
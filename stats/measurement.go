@@ -0,0 +1,285 @@
+package stats
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/d5/tengo/v2"
+)
+
+func objectMap(o tengo.Object) (map[string]tengo.Object, bool) {
+	switch m := o.(type) {
+	case *tengo.Map:
+		return m.Value, true
+	case *tengo.ImmutableMap:
+		return m.Value, true
+	case *tengo.Undefined:
+		return nil, true
+	}
+
+	return nil, false
+}
+
+// pointFromObjects builds a Point from tengo values, typing the fields as
+// they'll be written: ints as integers, floats, bools, and everything else
+// that converts to a string as a string. Undefined tags and fields are left
+// out.
+func pointFromObjects(name string, tags tengo.Object, fields tengo.Object, timestamp tengo.Object) (*Point, error) {
+	p := &Point{
+		Name:   name,
+		Tags:   make(map[string]string),
+		Fields: make(map[string]interface{}),
+	}
+
+	tagMap, ok := objectMap(tags)
+	if !ok {
+		return nil, fmt.Errorf("tags must be a map, found %s", tags.TypeName())
+	}
+
+	for k, v := range tagMap {
+		if v == tengo.UndefinedValue {
+			continue
+		}
+
+		s, ok := tengo.ToString(v)
+		if !ok {
+			return nil, fmt.Errorf("tag %s: unable to convert %s to a string", k, v.TypeName())
+		}
+		p.Tags[k] = s
+	}
+
+	fieldMap, ok := objectMap(fields)
+	if !ok {
+		return nil, fmt.Errorf("fields must be a map, found %s", fields.TypeName())
+	}
+
+	for k, v := range fieldMap {
+		switch v := v.(type) {
+		case *tengo.Undefined:
+		case *tengo.Int:
+			p.Fields[k] = v.Value
+		case *tengo.Float:
+			p.Fields[k] = v.Value
+		case *tengo.Bool:
+			p.Fields[k] = !v.IsFalsy()
+		case *tengo.String:
+			p.Fields[k] = v.Value
+		case *tengo.Char:
+			p.Fields[k] = string(v.Value)
+		default:
+			return nil, fmt.Errorf("field %s: unsupported type %s", k, v.TypeName())
+		}
+	}
+
+	switch ts := timestamp.(type) {
+	case nil, *tengo.Undefined:
+	case *tengo.Int:
+		p.Time = time.Unix(0, ts.Value)
+	case *tengo.Time:
+		p.Time = ts.Value
+	default:
+		return nil, fmt.Errorf("timestamp must be an int (nanoseconds) or time, found %s", timestamp.TypeName())
+	}
+
+	return p, nil
+}
+
+// pointFromRecord builds a Point from a structured measurement record, a map
+// of {name, tags, fields, [optional]time}.
+func pointFromRecord(record map[string]tengo.Object) (*Point, error) {
+	get := func(key string) tengo.Object {
+		if v, ok := record[key]; ok && v != nil {
+			return v
+		}
+		return tengo.UndefinedValue
+	}
+
+	name, ok := tengo.ToString(get("name"))
+	if !ok || name == "" {
+		return nil, fmt.Errorf("record is missing a name")
+	}
+
+	return pointFromObjects(name, get("tags"), get("fields"), get("time"))
+}
+
+// pointFromElement converts a single _MEASUREMENTS element, either a line
+// protocol string or a structured record, into a Point.
+func pointFromElement(o tengo.Object) (*Point, error) {
+	if record, ok := objectMap(o); ok && o != tengo.UndefinedValue {
+		p, err := pointFromRecord(record)
+		if err != nil {
+			return nil, err
+		}
+
+		// Make sure it encodes before handing it to the sinks.
+		if _, err := p.LineProtocol(); err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	}
+
+	line, ok := tengo.ToString(o)
+	if !ok {
+		return nil, fmt.Errorf("expected a string or map, found %s", o.TypeName())
+	}
+
+	return parseLine(line)
+}
+
+// namedMatches maps the named groups of the pattern to their matches.
+func namedMatches(re *regexp.Regexp, matches []string) map[string]string {
+	named := make(map[string]string)
+	for i, name := range re.SubexpNames() {
+		if name != "" && i < len(matches) {
+			named[name] = matches[i]
+		}
+	}
+
+	return named
+}
+
+// namedMatchesObject returns the named groups as a map for _NAMED.
+func namedMatchesObject(re *regexp.Regexp, matches []string) map[string]interface{} {
+	named := make(map[string]interface{})
+	for k, v := range namedMatches(re, matches) {
+		named[k] = v
+	}
+
+	return named
+}
+
+// convertField converts a matched string to the hinted field type. Thousands
+// separators are allowed in numbers, as Rust logs them that way.
+func convertField(value string, hint string) (interface{}, error) {
+	switch hint {
+	case "", "string":
+		return value, nil
+	case "int":
+		return strconv.ParseInt(strings.ReplaceAll(value, ",", ""), 10, 64)
+	case "float":
+		return strconv.ParseFloat(strings.ReplaceAll(value, ",", ""), 64)
+	case "bool":
+		return strconv.ParseBool(strings.ToLower(value))
+	}
+
+	return nil, fmt.Errorf("unknown type %s, must be one of string, int, float or bool", hint)
+}
+
+// validateNamed checks the tags and fields of a script-less monitored stat
+// all refer to named groups of the pattern, with valid types.
+func (o *MonitoredStatOptions) validateNamed(re *regexp.Regexp) error {
+	groups := make(map[string]bool)
+	for _, name := range re.SubexpNames() {
+		groups[name] = true
+	}
+
+	if len(o.Fields) == 0 {
+		return fmt.Errorf("at least one field is required")
+	}
+
+	for _, tag := range o.Tags {
+		if tag == "" || !groups[tag] {
+			return fmt.Errorf("tag %s isn't a named group in the pattern", tag)
+		}
+	}
+
+	for field, hint := range o.Fields {
+		if field == "" || !groups[field] {
+			return fmt.Errorf("field %s isn't a named group in the pattern", field)
+		}
+		switch hint {
+		case "", "string", "int", "float", "bool":
+		default:
+			return fmt.Errorf("field %s: unknown type %s, must be one of string, int, float or bool", field, hint)
+		}
+	}
+
+	return nil
+}
+
+// pointFromNamed builds the point for a script-less monitored stat from the
+// named groups of a match. Groups that didn't match anything are left out.
+func (o *MonitoredStatOptions) pointFromNamed(named map[string]string) (*Point, error) {
+	p := &Point{
+		Name:   o.Measurement,
+		Tags:   make(map[string]string),
+		Fields: make(map[string]interface{}),
+	}
+
+	for _, tag := range o.Tags {
+		if named[tag] != "" {
+			p.Tags[tag] = named[tag]
+		}
+	}
+
+	for field, hint := range o.Fields {
+		if named[field] == "" {
+			continue
+		}
+
+		v, err := convertField(named[field], hint)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", field, err)
+		}
+		p.Fields[field] = v
+	}
+
+	if _, err := p.LineProtocol(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// CanCall returns true since we're a function type.
+func (o *TengoMeasurement) CanCall() bool {
+	return true
+}
+
+// TypeName returns the function name
+func (o *TengoMeasurement) TypeName() string {
+	return "measurement"
+}
+
+// String returns the function name
+func (o *TengoMeasurement) String() string {
+	return "measurement"
+}
+
+// Call builds a correctly escaped and typed line protocol string.
+// measurement(name, tags, fields, [optional]timestamp)
+func (o *TengoMeasurement) Call(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) < 3 || len(args) > 4 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+
+	name, ok := tengo.ToString(args[0])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "first",
+			Expected: "string",
+			Found:    args[0].TypeName(),
+		}
+	}
+
+	var timestamp tengo.Object
+	if len(args) > 3 {
+		timestamp = args[3]
+	}
+
+	p, err := pointFromObjects(name, args[1], args[2], timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("measurement: %s", err)
+	}
+
+	line, err := p.LineProtocol()
+	if err != nil {
+		return nil, fmt.Errorf("measurement: %s", err)
+	}
+
+	return &tengo.String{Value: line}, nil
+}
@@ -0,0 +1,152 @@
+package stats
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// PrometheusSink keeps the latest value of every numeric field, and serves
+// them as gauges in the Prometheus text format on Listen at /metrics. Each
+// field becomes a metric named measurement_field, labelled with the point's
+// tags. Series not written for Expire seconds are dropped.
+type PrometheusSink struct {
+	Listen string
+	Expire int
+	mu     sync.Mutex
+	series map[string]*promSeries
+}
+
+type promSeries struct {
+	metric  string
+	labels  string
+	value   float64
+	updated time.Time
+}
+
+var promInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+var promLabelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// promName converts s to a valid metric or label name.
+func promName(s string) string {
+	s = promInvalidChars.ReplaceAllString(s, "_")
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		s = "_" + s
+	}
+
+	return s
+}
+
+// Name returns the sink name
+func (s *PrometheusSink) Name() string {
+	return "prometheus"
+}
+
+// Write records the latest value of each numeric and bool field. String
+// fields can't be represented and are skipped. The bucket is ignored.
+func (s *PrometheusSink) Write(bucket string, points []*Point) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.series == nil {
+		s.series = make(map[string]*promSeries)
+	}
+
+	now := time.Now()
+	for _, p := range points {
+		tags := make([]string, 0, len(p.Tags))
+		for k := range p.Tags {
+			tags = append(tags, k)
+		}
+		sort.Strings(tags)
+
+		var labels []string
+		for _, k := range tags {
+			labels = append(labels, promName(k)+"=\""+promLabelEscaper.Replace(p.Tags[k])+"\"")
+		}
+
+		for field := range p.Fields {
+			value, ok := p.FieldFloat(field)
+			if !ok {
+				continue
+			}
+
+			metric := promName(p.Name + "_" + field)
+			key := metric + "{" + strings.Join(labels, ",") + "}"
+			s.series[key] = &promSeries{
+				metric:  metric,
+				labels:  strings.Join(labels, ","),
+				value:   value,
+				updated: now,
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *PrometheusSink) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+
+	expire := time.Duration(s.Expire) * time.Second
+	keys := make([]string, 0, len(s.series))
+	for k, series := range s.series {
+		if expire > 0 && time.Since(series.updated) > expire {
+			delete(s.series, k)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	last := ""
+	for _, k := range keys {
+		series := s.series[k]
+		if series.metric != last {
+			b.WriteString("# TYPE " + series.metric + " gauge\n")
+			last = series.metric
+		}
+
+		b.WriteString(series.metric)
+		if series.labels != "" {
+			b.WriteString("{" + series.labels + "}")
+		}
+		b.WriteString(" " + strconv.FormatFloat(series.value, 'g', -1, 64) + "\n")
+	}
+
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// Serve serves /metrics until done is closed.
+func (s *PrometheusSink) Serve(done chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	defer wg.Done()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	server := &http.Server{Addr: s.Listen, Handler: mux}
+
+	go func() {
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	zap.S().Infof("Serving Prometheus metrics on %s/metrics", s.Listen)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		zap.S().Errorf("Prometheus listener failed: %s", err)
+	}
+}
@@ -0,0 +1,239 @@
+package stats
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RotatingFile is an append only file that's rotated once it reaches MaxSize
+// bytes, or has been open for Interval. Rotated files are renamed with the
+// time of rotation, gzipped if Compress is set, and removed once there are
+// more than MaxFiles of them or they're older than MaxAge. Zero values disable
+// each limit.
+type RotatingFile struct {
+	Path     string
+	MaxSize  int64
+	Interval time.Duration
+	Compress bool
+	MaxFiles int
+	MaxAge   time.Duration
+	// Header is written at the start of every new file.
+	Header []byte
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	closed bool
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+
+	if f.size == 0 && len(f.Header) > 0 {
+		n, err := f.file.Write(f.Header)
+		f.size += int64(n)
+		return err
+	}
+
+	return nil
+}
+
+// rotatedPrefix returns the prefix and extension surrounding the timestamp in
+// rotated file names, so foo.jsonl is rotated to foo-20060102T150405.jsonl.
+func (f *RotatingFile) rotatedPrefix() (string, string) {
+	ext := filepath.Ext(f.Path)
+	return strings.TrimSuffix(f.Path, ext) + "-", ext
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	prefix, ext := f.rotatedPrefix()
+	name := prefix + time.Now().Format("20060102T150405") + ext
+	for i := 1; fileExists(name) || fileExists(name+".gz"); i++ {
+		name = fmt.Sprintf("%s%s.%d%s", prefix, time.Now().Format("20060102T150405"), i, ext)
+	}
+
+	if err := os.Rename(f.Path, name); err != nil {
+		return err
+	}
+
+	zap.S().Infof("Rotated %s to %s", f.Path, name)
+
+	// Compressing a large file can take a while, don't hold up writes.
+	go func() {
+		if f.Compress {
+			if err := gzipFile(name); err != nil {
+				zap.S().Errorf("Error compressing %s: %s", name, err)
+			}
+		}
+		f.prune()
+	}()
+
+	return f.open()
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	return os.Remove(name)
+}
+
+// prune removes the rotated files past the retention limits.
+func (f *RotatingFile) prune() {
+	if f.MaxFiles <= 0 && f.MaxAge <= 0 {
+		return
+	}
+
+	prefix, ext := f.rotatedPrefix()
+	matches, err := filepath.Glob(prefix + "[0-9]*T*" + ext + "*")
+	if err != nil {
+		zap.S().Errorf("Error listing rotated files of %s: %s", f.Path, err)
+		return
+	}
+
+	modTimes := make(map[string]time.Time)
+	for _, name := range matches {
+		if info, err := os.Stat(name); err == nil {
+			modTimes[name] = info.ModTime()
+		}
+	}
+
+	// Oldest first, names are only a tie breaker since several files can be
+	// rotated in the same second.
+	sort.Slice(matches, func(i, j int) bool {
+		if !modTimes[matches[i]].Equal(modTimes[matches[j]]) {
+			return modTimes[matches[i]].Before(modTimes[matches[j]])
+		}
+		return matches[i] < matches[j]
+	})
+
+	for i, name := range matches {
+		remove := f.MaxFiles > 0 && len(matches)-i > f.MaxFiles
+		if !remove && f.MaxAge > 0 && time.Since(modTimes[name]) > f.MaxAge {
+			remove = true
+		}
+
+		if remove {
+			zap.S().Infof("Removing rotated file %s", name)
+			if err := os.Remove(name); err != nil {
+				zap.S().Errorf("Error removing rotated file %s: %s", name, err)
+			}
+		}
+	}
+}
+
+// Write appends p to the file, rotating it first if needed. A single write is
+// never split across files.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, fmt.Errorf("%s is closed", f.Path)
+	}
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	full := f.MaxSize > 0 && f.size > int64(len(f.Header)) && f.size+int64(len(p)) > f.MaxSize
+	expired := f.Interval > 0 && time.Since(f.opened) >= f.Interval && f.size > int64(len(f.Header))
+	if full || expired {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Close closes the file, any further writes fail.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
+
+// CloseOnDone is intended to be run as a goroutine, and closes the file on
+// shutdown.
+func (f *RotatingFile) CloseOnDone(done chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	defer wg.Done()
+
+	<-done
+	if err := f.Close(); err != nil {
+		zap.S().Errorf("Error closing %s: %s", f.Path, err)
+	}
+}
@@ -0,0 +1,124 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+)
+
+// Sink receives every point written by the stats scripts, so the same script
+// can feed several backends.
+type Sink interface {
+	Name() string
+	Write(bucket string, points []*Point) error
+}
+
+// pointRecord is the JSON encoding of a point used by the file and redis
+// stream sinks.
+type pointRecord struct {
+	Tag    string                 `json:"tag,omitempty"`
+	Bucket string                 `json:"bucket"`
+	Name   string                 `json:"name"`
+	Tags   map[string]string      `json:"tags"`
+	Fields map[string]interface{} `json:"fields"`
+	Time   int64                  `json:"time,omitempty"`
+}
+
+func newPointRecord(bucket string, p *Point) *pointRecord {
+	r := &pointRecord{Bucket: bucket, Name: p.Name, Tags: p.Tags, Fields: p.Fields}
+	if !p.Time.IsZero() {
+		r.Time = p.Time.UnixNano()
+	}
+
+	return r
+}
+
+// InfluxSink writes points to InfluxDB, using the bucket as the retention
+// policy.
+type InfluxSink struct {
+	Client   influxdb2.Client
+	Database string
+}
+
+// Name returns the sink name
+func (s *InfluxSink) Name() string {
+	return "influx"
+}
+
+// Write writes the points as line protocol.
+func (s *InfluxSink) Write(bucket string, points []*Point) error {
+	lines := make([]string, 0, len(points))
+	for _, p := range points {
+		line, err := p.LineProtocol()
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+
+	writeAPI := s.Client.WriteAPIBlocking("", fmt.Sprintf("%s/%s", s.Database, bucket))
+
+	return writeAPI.WriteRecord(context.Background(), strings.Join(lines, "\n"))
+}
+
+// RedisStreamSink adds every point to a redis stream, trimmed to roughly
+// MaxLen entries.
+type RedisStreamSink struct {
+	Pool   *redis.Pool
+	Key    string
+	MaxLen int
+}
+
+// Name returns the sink name
+func (s *RedisStreamSink) Name() string {
+	return "redis_stream"
+}
+
+// Write adds the points to the stream, with the tags and fields JSON encoded.
+func (s *RedisStreamSink) Write(bucket string, points []*Point) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	for _, p := range points {
+		r := newPointRecord(bucket, p)
+
+		tags, err := json.Marshal(r.Tags)
+		if err != nil {
+			return err
+		}
+
+		fields, err := json.Marshal(r.Fields)
+		if err != nil {
+			return err
+		}
+
+		args := redis.Args{s.Key}
+		if s.MaxLen > 0 {
+			args = args.Add("MAXLEN", "~", s.MaxLen)
+		}
+		args = args.Add("*", "bucket", r.Bucket, "name", r.Name, "tags", tags, "fields", fields)
+		if r.Time != 0 {
+			args = args.Add("time", r.Time)
+		}
+
+		if err := conn.Send("XADD", args...); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	for range points {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
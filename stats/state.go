@@ -0,0 +1,144 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/diametric/rustcon/scheduler"
+)
+
+// statState tracks the runs of a single stat, for introspection.
+type statState struct {
+	mu        sync.Mutex
+	runs      int64
+	errors    int64
+	lastRun   time.Time
+	lastError string
+	errorTime time.Time
+	reloaded  time.Time
+}
+
+func (s *statState) recordRun(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.runs++
+	s.lastRun = time.Now()
+	if err != nil {
+		s.errors++
+		s.lastError = err.Error()
+		s.errorTime = s.lastRun
+	}
+}
+
+func (s *statState) recordReload() {
+	s.mu.Lock()
+	s.reloaded = time.Now()
+	s.mu.Unlock()
+}
+
+// StatState is the state of a registered stat. Runs and errors count script
+// runs, or matches for a script-less monitored stat. Reloaded is when the
+// script was last recompiled after changing on disk.
+type StatState struct {
+	Type        string             `json:"type"`
+	Script      string             `json:"script,omitempty"`
+	Command     string             `json:"command,omitempty"`
+	Pattern     string             `json:"pattern,omitempty"`
+	Measurement string             `json:"measurement,omitempty"`
+	Interval    scheduler.Duration `json:"interval,omitempty"`
+	Offset      scheduler.Duration `json:"offset,omitempty"`
+	Jitter      scheduler.Duration `json:"jitter,omitempty"`
+	Runs        int64              `json:"runs"`
+	Errors      int64              `json:"errors"`
+	LastRun     *time.Time         `json:"last_run"`
+	LastError   string             `json:"last_error,omitempty"`
+	ErrorTime   *time.Time         `json:"last_error_time,omitempty"`
+	Reloaded    *time.Time         `json:"reloaded"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+func (impl *StatsImpl) stateOf(kind string) StatState {
+	impl.state.mu.Lock()
+	defer impl.state.mu.Unlock()
+
+	return StatState{
+		Type:      kind,
+		Script:    impl.scriptpath,
+		Runs:      impl.state.runs,
+		Errors:    impl.state.errors,
+		LastRun:   optionalTime(impl.state.lastRun),
+		LastError: impl.state.lastError,
+		ErrorTime: optionalTime(impl.state.errorTime),
+		Reloaded:  optionalTime(impl.state.reloaded),
+	}
+}
+
+// StatStates returns the state of every registered stat, invoked stats
+// first, then internal and monitored stats.
+func (client *Client) StatStates() []StatState {
+	states := make([]StatState, 0, len(client.stats)+len(client.internalStats)+len(client.monitoredStats))
+
+	for _, stat := range client.stats {
+		state := stat.stateOf("invoked")
+		state.Command = stat.command
+		state.Interval = scheduler.Duration(stat.interval)
+		state.Offset = scheduler.Duration(stat.offset)
+		state.Jitter = scheduler.Duration(stat.jitter)
+		states = append(states, state)
+	}
+
+	for _, stat := range client.internalStats {
+		state := stat.stateOf("internal")
+		state.Interval = scheduler.Duration(stat.interval)
+		state.Offset = scheduler.Duration(stat.offset)
+		state.Jitter = scheduler.Duration(stat.jitter)
+		states = append(states, state)
+	}
+
+	for _, stat := range client.monitoredStats {
+		state := stat.stateOf("monitored")
+		state.Pattern = stat.pattern
+		state.Measurement = stat.Measurement
+		states = append(states, state)
+	}
+
+	return states
+}
+
+// Scheduler returns the scheduler running the invoked and internal stats, for
+// its job stats.
+func (client *Client) Scheduler() *scheduler.Scheduler {
+	return &client.scheduler
+}
+
+// Ping checks InfluxDB is reachable and healthy.
+func (client *Client) Ping(ctx context.Context) error {
+	if client.influxDb == nil {
+		return fmt.Errorf("InfluxDB isn't configured")
+	}
+
+	health, err := client.influxDb.Health(ctx)
+	if err != nil {
+		return err
+	}
+
+	if health == nil || health.Status != "pass" {
+		message := "no response"
+		if health != nil && health.Message != nil {
+			message = *health.Message
+		}
+		return fmt.Errorf("InfluxDB is unhealthy: %s", message)
+	}
+
+	return nil
+}
@@ -0,0 +1,229 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/d5/tengo/v2"
+)
+
+// NotificationTarget is a named destination for alerts and webhooks, so
+// scripts and alert rules don't need webhook URLs embedded in them. Type is
+// one of discord, slack or http. If Template is set it's rendered as the
+// request body for every type, otherwise discord and slack get their usual
+// payloads and http gets the payload encoded as JSON.
+type NotificationTarget struct {
+	Type     string            `json:"type"`
+	URL      string            `json:"url"`
+	Username string            `json:"username"`
+	Method   string            `json:"method"`
+	Headers  map[string]string `json:"headers"`
+	Auth     *TargetAuth       `json:"auth"`
+	Template string            `json:"template"`
+	template *template.Template
+}
+
+// TargetAuth contains the authentication for a notification target. Type is
+// one of basic or bearer.
+type TargetAuth struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+// TargetTemplateData is passed to target body templates. Payload holds the
+// map passed to http_webhook(), and is nil for alerts.
+type TargetTemplateData struct {
+	Tag      string
+	Message  string
+	Severity string
+	Key      string
+	Payload  interface{}
+}
+
+var targetTemplateFuncs = template.FuncMap{
+	// json encodes a value, for safely embedding strings in JSON bodies.
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// InitTarget validates the target and compiles its template.
+func (t *NotificationTarget) InitTarget(name string) error {
+	switch t.Type {
+	case "discord", "slack", "http":
+	default:
+		return fmt.Errorf("target %s: unknown type %s, must be one of discord, slack or http", name, t.Type)
+	}
+
+	if t.URL == "" {
+		return fmt.Errorf("target %s: url is required", name)
+	}
+
+	if t.Auth != nil && t.Auth.Type != "basic" && t.Auth.Type != "bearer" {
+		return fmt.Errorf("target %s: unknown auth type %s, must be one of basic or bearer", name, t.Auth.Type)
+	}
+
+	if t.Template != "" {
+		tmpl, err := template.New(name).Funcs(targetTemplateFuncs).Parse(t.Template)
+		if err != nil {
+			return fmt.Errorf("target %s: %s", name, err)
+		}
+		t.template = tmpl
+	}
+
+	return nil
+}
+
+func (t *NotificationTarget) body(data *TargetTemplateData) ([]byte, error) {
+	if t.template != nil {
+		var b bytes.Buffer
+		if err := t.template.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+
+	message := data.Message
+	if data.Severity != "" {
+		message = fmt.Sprintf("[%s] %s", strings.ToUpper(data.Severity), data.Message)
+	}
+
+	switch t.Type {
+	case "discord":
+		return json.Marshal(DiscordWebhookData{Username: t.Username, Content: message})
+	case "slack":
+		return json.Marshal(SlackWebhookData{Text: message})
+	}
+
+	if data.Payload != nil {
+		return json.Marshal(data.Payload)
+	}
+
+	return json.Marshal(map[string]string{
+		"tag":      data.Tag,
+		"message":  data.Message,
+		"severity": data.Severity,
+		"key":      data.Key,
+	})
+}
+
+// Send renders the body and sends it to the target, retrying if rate limited.
+func (t *NotificationTarget) Send(data *TargetTemplateData) (*webhookResponse, error) {
+	return t.send(data, rateLimitMaxRetryWait)
+}
+
+// send sends to the target, waiting up to maxWait in total on rate limits.
+func (t *NotificationTarget) send(data *TargetTemplateData, maxWait time.Duration) (*webhookResponse, error) {
+	body, err := t.body(data)
+	if err != nil {
+		return nil, err
+	}
+
+	method := t.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	headers := map[string]string{"Content-Type": "application/json"}
+	for k, v := range t.Headers {
+		headers[k] = v
+	}
+
+	if t.Auth != nil {
+		switch t.Auth.Type {
+		case "basic":
+			headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString(
+				[]byte(t.Auth.Username+":"+t.Auth.Password))
+		case "bearer":
+			headers["Authorization"] = "Bearer " + t.Auth.Token
+		}
+	}
+
+	return retryRateLimited(func() (*webhookResponse, error) {
+		return sendWebhookRequest(method, t.URL, headers, body)
+	}, maxWait)
+}
+
+// resolveWebhookURL lets the webhook functions take a target name in place of
+// a URL.
+func resolveWebhookURL(targets map[string]*NotificationTarget, url string) string {
+	if t, ok := targets[url]; ok {
+		return t.URL
+	}
+
+	return url
+}
+
+// CanCall returns true since we're a function type.
+func (o *TengoHTTPWebhook) CanCall() bool {
+	return true
+}
+
+// TypeName returns the function name
+func (o *TengoHTTPWebhook) TypeName() string {
+	return "http_webhook"
+}
+
+// String returns the function name
+func (o *TengoHTTPWebhook) String() string {
+	return "http_webhook"
+}
+
+// Call sends payload to a named notification target, or POSTs it as JSON if
+// given a URL instead. Returns a map containing status, body and error.
+// http_webhook(target, payload)
+func (o *TengoHTTPWebhook) Call(args ...tengo.Object) (ret tengo.Object, err error) {
+	if len(args) != 2 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+
+	name, ok := tengo.ToString(args[0])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "first",
+			Expected: "string",
+			Found:    args[0].TypeName(),
+		}
+	}
+
+	target, ok := o.targets[name]
+	if !ok {
+		if !strings.HasPrefix(name, "http://") && !strings.HasPrefix(name, "https://") {
+			return nil, fmt.Errorf("http_webhook: unknown notification target %s", name)
+		}
+		target = &NotificationTarget{Type: "http", URL: name}
+	}
+
+	data := &TargetTemplateData{Tag: o.tag, Payload: tengo.ToInterface(args[1])}
+	if s, ok := args[1].(*tengo.String); ok {
+		data.Message = s.Value
+	}
+	if m, ok := data.Payload.(map[string]interface{}); ok {
+		data.Message, _ = m["message"].(string)
+		data.Severity, _ = m["severity"].(string)
+		data.Key, _ = m["key"].(string)
+	}
+
+	if o.test {
+		body, err := target.body(data)
+		if err != nil {
+			return webhookResultObject(nil, err), nil
+		}
+		return webhookResultObject(testWebhook("http", target.URL, body)), nil
+	}
+
+	resp, err := target.send(data, scriptRateLimitWait)
+
+	return webhookResultObject(resp, err), nil
+}
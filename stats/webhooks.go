@@ -7,16 +7,97 @@ package stats
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/d5/tengo/v2"
+	"go.uber.org/zap"
 )
 
-// DiscordWebhookData contains a simple webhook message, no embed support (yet, maybe I dunno)
+const (
+	rateLimitMaxRetries = 3
+	// rateLimitMaxRetryWait is the longest the dispatcher waits in total on
+	// rate limits for a single alert.
+	rateLimitMaxRetryWait = 30 * time.Second
+	// scriptRateLimitWait is the longest a script calling a webhook directly
+	// waits in total, so a rate limited webhook doesn't hold up the stat's
+	// schedule. After that the 429 is returned to the script, and notify()
+	// can be used to have the dispatcher retry it in the background.
+	scriptRateLimitWait    = 2 * time.Second
+	maxWebhookResponseBody = 64 * 1024
+)
+
+// DiscordWebhookData contains the webhook message, including embeds.
 type DiscordWebhookData struct {
-	Username string `json:"username,omitempty"`
-	Content  string `json:"content"`
+	Username        string                  `json:"username,omitempty"`
+	AvatarURL       string                  `json:"avatar_url,omitempty"`
+	Content         string                  `json:"content,omitempty"`
+	TTS             bool                    `json:"tts,omitempty"`
+	Embeds          []DiscordEmbed          `json:"embeds,omitempty"`
+	AllowedMentions *DiscordAllowedMentions `json:"allowed_mentions,omitempty"`
+	ThreadName      string                  `json:"thread_name,omitempty"`
+	ThreadID        string                  `json:"-"`
+}
+
+// DiscordEmbed contains a single rich embed
+type DiscordEmbed struct {
+	Title       string              `json:"title,omitempty"`
+	Description string              `json:"description,omitempty"`
+	URL         string              `json:"url,omitempty"`
+	Color       int                 `json:"color,omitempty"`
+	Timestamp   *time.Time          `json:"timestamp,omitempty"`
+	Footer      *DiscordEmbedFooter `json:"footer,omitempty"`
+	Author      *DiscordEmbedAuthor `json:"author,omitempty"`
+	Thumbnail   *DiscordEmbedImage  `json:"thumbnail,omitempty"`
+	Image       *DiscordEmbedImage  `json:"image,omitempty"`
+	Fields      []DiscordEmbedField `json:"fields,omitempty"`
+}
+
+// DiscordEmbedFooter contains the footer of an embed
+type DiscordEmbedFooter struct {
+	Text    string `json:"text"`
+	IconURL string `json:"icon_url,omitempty"`
+}
+
+// DiscordEmbedAuthor contains the author of an embed
+type DiscordEmbedAuthor struct {
+	Name    string `json:"name"`
+	URL     string `json:"url,omitempty"`
+	IconURL string `json:"icon_url,omitempty"`
+}
+
+// DiscordEmbedImage contains an embed image or thumbnail
+type DiscordEmbedImage struct {
+	URL string `json:"url"`
+}
+
+// DiscordEmbedField contains a single embed field
+type DiscordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline,omitempty"`
+}
+
+// DiscordAllowedMentions controls who can be pinged by the message
+type DiscordAllowedMentions struct {
+	Parse       []string `json:"parse"`
+	Roles       []string `json:"roles,omitempty"`
+	Users       []string `json:"users,omitempty"`
+	RepliedUser bool     `json:"replied_user,omitempty"`
+}
+
+// webhookResponse contains the parts of a webhook HTTP response scripts care
+// about. The body is read and closed before returning.
+type webhookResponse struct {
+	StatusCode int
+	Body       string
+	Header     http.Header
 }
 
 // SlackWebhookData contains the webhook message for slack
@@ -40,7 +121,7 @@ func (o *TengoSlackWebhook) String() string {
 }
 
 // Call provides the logger functionality.
-// slack_webhook(hookurl, text)
+// slack_webhook(hookurl or target, text)
 func (o *TengoSlackWebhook) Call(args ...tengo.Object) (ret tengo.Object, err error) {
 	if len(args) != 2 {
 		return nil, tengo.ErrWrongNumArguments
@@ -56,6 +137,7 @@ func (o *TengoSlackWebhook) Call(args ...tengo.Object) (ret tengo.Object, err er
 			Found:    args[0].TypeName(),
 		}
 	}
+	url = resolveWebhookURL(o.targets, url)
 
 	s2, ok := tengo.ToString(args[1])
 	if !ok {
@@ -68,7 +150,12 @@ func (o *TengoSlackWebhook) Call(args ...tengo.Object) (ret tengo.Object, err er
 	dmsg.Text = s2
 
 	dbody, _ := json.Marshal(dmsg)
-	resp, err := sendWebhookData(url, dbody)
+	var resp *webhookResponse
+	if o.test {
+		resp, err = testWebhook("slack", url, dbody)
+	} else {
+		resp, err = sendWebhookData(url, dbody)
+	}
 
 	if err != nil {
 		return &tengo.Int{Value: -1}, nil
@@ -92,13 +179,43 @@ func (o *TengoDiscordWebhook) String() string {
 	return "discord_webhook"
 }
 
-// Call provides the logger functionality.
-// discord_webhook(hookurl, content, [optional]username)
+// Call provides the discord webhook functionality. The payload form accepts
+// a map with any of the fields in DiscordWebhookData and returns a map with
+// status, body and error keys. The simple form returns only the status code.
+// discord_webhook(hookurl or target, content, [optional]username)
+// discord_webhook(hookurl or target, payload)
 func (o *TengoDiscordWebhook) Call(args ...tengo.Object) (ret tengo.Object, err error) {
 	if len(args) > 3 || len(args) < 2 {
 		return nil, tengo.ErrWrongNumArguments
 	}
 
+	url, ok := tengo.ToString(args[0])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "first",
+			Expected: "string",
+			Found:    args[0].TypeName(),
+		}
+	}
+	url = resolveWebhookURL(o.targets, url)
+
+	switch args[1].(type) {
+	case *tengo.Map, *tengo.ImmutableMap:
+		if len(args) > 2 {
+			return nil, tengo.ErrWrongNumArguments
+		}
+
+		dmsg, err := discordPayloadFromObject(args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		dbody, _ := json.Marshal(dmsg)
+		resp, err := o.send(discordThreadURL(url, dmsg.ThreadID), dbody)
+
+		return webhookResultObject(resp, err), nil
+	}
+
 	dmsg := DiscordWebhookData{}
 	if len(args) > 2 {
 		s3, ok := tengo.ToString(args[2])
@@ -112,27 +229,18 @@ func (o *TengoDiscordWebhook) Call(args ...tengo.Object) (ret tengo.Object, err
 		dmsg.Username = s3
 	}
 
-	url, ok := tengo.ToString(args[0])
-	if !ok {
-		return nil, tengo.ErrInvalidArgumentType{
-			Name:     "first",
-			Expected: "string",
-			Found:    args[0].TypeName(),
-		}
-	}
-
 	s2, ok := tengo.ToString(args[1])
 	if !ok {
 		return nil, tengo.ErrInvalidArgumentType{
 			Name:     "second",
-			Expected: "string",
-			Found:    args[0].TypeName(),
+			Expected: "string or map",
+			Found:    args[1].TypeName(),
 		}
 	}
 	dmsg.Content = s2
 
 	dbody, _ := json.Marshal(dmsg)
-	resp, err := sendWebhookData(url, dbody)
+	resp, err := o.send(url, dbody)
 
 	if err != nil {
 		return &tengo.Int{Value: -1}, nil
@@ -141,13 +249,223 @@ func (o *TengoDiscordWebhook) Call(args ...tengo.Object) (ret tengo.Object, err
 	return &tengo.Int{Value: int64(resp.StatusCode)}, nil
 }
 
-func sendWebhookData(url string, data []byte) (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data))
+// send sends the webhook, or only logs it in test mode.
+func (o *TengoDiscordWebhook) send(url string, data []byte) (*webhookResponse, error) {
+	if o.test {
+		return testWebhook("discord", url, data)
+	}
+
+	return sendDiscordWebhook(url, data)
+}
+
+// discordPayloadFromObject converts a tengo map into the webhook payload. It
+// goes through JSON so the field names match Discord's API exactly.
+func discordPayloadFromObject(o tengo.Object) (*DiscordWebhookData, error) {
+	payload, _ := tengo.ToInterface(o).(map[string]interface{})
+
+	// Accept both spellings of colour, colours as strings and unix timestamps.
+	if embeds, ok := payload["embeds"].([]interface{}); ok {
+		for _, e := range embeds {
+			if embed, ok := e.(map[string]interface{}); ok {
+				if c, ok := embed["colour"]; ok {
+					embed["color"] = c
+					delete(embed, "colour")
+				}
+				if c, ok := embed["color"].(string); ok {
+					parsed, err := parseColor(c)
+					if err != nil {
+						return nil, fmt.Errorf("invalid embed color %s", c)
+					}
+					embed["color"] = parsed
+				}
+				if ts, ok := embed["timestamp"].(int64); ok {
+					embed["timestamp"] = time.Unix(ts, 0)
+				}
+			}
+		}
+	}
+
+	// Thread IDs are snowflakes, scripts will usually pass them as strings
+	// but allow ints as well. They're sent in the query string, not the body.
+	var threadID string
+	switch id := payload["thread_id"].(type) {
+	case string:
+		threadID = id
+	case int64:
+		threadID = fmt.Sprintf("%d", id)
+	}
+	delete(payload, "thread_id")
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	dmsg := &DiscordWebhookData{}
+	if err := json.Unmarshal(data, dmsg); err != nil {
+		return nil, tengo.ErrInvalidArgumentType{
+			Name:     "second",
+			Expected: "discord webhook payload",
+			Found:    err.Error(),
+		}
+	}
+	dmsg.ThreadID = threadID
+
+	return dmsg, nil
+}
+
+// parseColor parses an embed colour given as a string, either hex with a #
+// or 0x prefix, or decimal like "16711680". Hex without a prefix, like
+// "ff0000", is still accepted as long as it isn't all digits.
+func parseColor(c string) (int64, error) {
+	s := strings.TrimSpace(c)
+
+	base := 10
+	switch {
+	case strings.HasPrefix(s, "#"):
+		s, base = s[1:], 16
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		s, base = s[2:], 16
+	case strings.Trim(s, "0123456789") != "":
+		base = 16
+	}
+
+	color, err := strconv.ParseInt(s, base, 32)
+	if err != nil {
+		return 0, err
+	}
+	if color < 0 || color > 0xffffff {
+		return 0, fmt.Errorf("color %s is out of range", c)
+	}
+
+	return color, nil
+}
+
+// Threads are selected through the query string, not the payload.
+func discordThreadURL(hookurl string, threadID string) string {
+	if threadID == "" {
+		return hookurl
+	}
+
+	u, err := neturl.Parse(hookurl)
+	if err != nil {
+		return hookurl
+	}
+
+	q := u.Query()
+	q.Set("thread_id", threadID)
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// testWebhook logs a webhook instead of sending it, for test mode and
+// replays, and answers it the way a successful send would.
+func testWebhook(kind string, url string, data []byte) (*webhookResponse, error) {
+	zap.S().Infof("TEST: %s webhook to %s: %s", kind, url, data)
+	return &webhookResponse{StatusCode: 200, Header: http.Header{}}, nil
+}
+
+// sendDiscordWebhook sends a script's webhook, waiting and retrying briefly
+// when Discord rate limits us.
+func sendDiscordWebhook(url string, data []byte) (*webhookResponse, error) {
+	return retryRateLimited(func() (*webhookResponse, error) {
+		return sendWebhookData(url, data)
+	}, scriptRateLimitWait)
+}
+
+// retryRateLimited retries send while it's rate limited with a 429, waiting as
+// long as the response asks, up to maxWait in total. Discord sends
+// retry_after in the body, most other services use the Retry-After header.
+func retryRateLimited(send func() (*webhookResponse, error), maxWait time.Duration) (*webhookResponse, error) {
+	var waited time.Duration
+	for attempt := 0; ; attempt++ {
+		resp, err := send()
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= rateLimitMaxRetries {
+			return resp, err
+		}
+
+		wait := retryAfter(resp)
+		if waited+wait > maxWait {
+			zap.S().Warnf("Webhook rate limited for %s, not retrying.", wait)
+			return resp, nil
+		}
+		waited += wait
+
+		zap.S().Warnf("Webhook rate limited, retrying in %s", wait)
+		time.Sleep(wait)
+	}
+}
+
+// retryAfter reads how long we've been asked to wait, from the JSON body if
+// present, otherwise the Retry-After header.
+func retryAfter(resp *webhookResponse) time.Duration {
+	var ratelimit struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+
+	if err := json.Unmarshal([]byte(resp.Body), &ratelimit); err == nil && ratelimit.RetryAfter > 0 {
+		return time.Duration(ratelimit.RetryAfter * float64(time.Second))
+	}
+
+	if seconds, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil {
+		return time.Duration(seconds * float64(time.Second))
+	}
+
+	return time.Second
+}
+
+// webhookResultObject builds the map returned to scripts from payload style
+// webhook calls.
+func webhookResultObject(resp *webhookResponse, err error) tengo.Object {
+	result := &tengo.Map{Value: map[string]tengo.Object{
+		"status": &tengo.Int{Value: -1},
+		"body":   &tengo.String{Value: ""},
+		"error":  &tengo.String{Value: ""},
+	}}
+
+	if err != nil {
+		result.Value["error"] = &tengo.String{Value: err.Error()}
+		return result
+	}
+
+	result.Value["status"] = &tengo.Int{Value: int64(resp.StatusCode)}
+	result.Value["body"] = &tengo.String{Value: resp.Body}
+	if resp.StatusCode >= 300 {
+		result.Value["error"] = &tengo.String{Value: resp.Body}
+	}
+
+	return result
+}
+
+func sendWebhookData(url string, data []byte) (*webhookResponse, error) {
+	return sendWebhookRequest(http.MethodPost, url, map[string]string{"Content-Type": "application/json"}, data)
+}
+
+func sendWebhookRequest(method string, url string, headers map[string]string, data []byte) (*webhookResponse, error) {
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(data))
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 	client := &http.Client{Timeout: 10 * time.Second}
-	return client.Do(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxWebhookResponseBody))
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhookResponse{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		Header:     resp.Header,
+	}, nil
 }
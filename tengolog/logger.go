@@ -1,4 +1,6 @@
-package stats
+// Package tengolog provides the logger() function shared by the stats scripts
+// and the middleware's transform scripts.
+package tengolog
 
 import (
 	"strings"
@@ -7,23 +9,28 @@ import (
 	"go.uber.org/zap"
 )
 
+// Logger defines the object type for the logger functions
+type Logger struct {
+	tengo.ObjectImpl
+}
+
 // CanCall returns true since we're a function type.
-func (o *TengoLogger) CanCall() bool {
+func (o *Logger) CanCall() bool {
 	return true
 }
 
 // TypeName returns the logger name
-func (o *TengoLogger) TypeName() string {
+func (o *Logger) TypeName() string {
 	return "logger"
 }
 
 // String returns the logger name
-func (o *TengoLogger) String() string {
+func (o *Logger) String() string {
 	return "logger"
 }
 
 // Call provides the logger functionality.
-func (o *TengoLogger) Call(args ...tengo.Object) (ret tengo.Object, err error) {
+func (o *Logger) Call(args ...tengo.Object) (ret tengo.Object, err error) {
 	if len(args) != 2 {
 		return nil, tengo.ErrWrongNumArguments
 	}
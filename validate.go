@@ -0,0 +1,575 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/diametric/rustcon/middleware"
+	"github.com/diametric/rustcon/rust"
+	"github.com/diametric/rustcon/scheduler"
+	"github.com/diametric/rustcon/stats"
+	"github.com/diametric/rustcon/webrcon"
+)
+
+// configProblem is a single problem found in the config, at a JSON path.
+type configProblem struct {
+	Path    string
+	Message string
+	Warning bool
+}
+
+func (p configProblem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+
+	path := p.Path
+	if path == "" {
+		path = "(root)"
+	}
+
+	return fmt.Sprintf("%s: %s: %s", level, path, p.Message)
+}
+
+type configValidator struct {
+	problems []configProblem
+}
+
+func (v *configValidator) errorf(path string, format string, args ...interface{}) {
+	v.problems = append(v.problems, configProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *configValidator) warnf(path string, format string, args ...interface{}) {
+	v.problems = append(v.problems, configProblem{Path: path, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+func (v *configValidator) errors() int {
+	count := 0
+	for _, p := range v.problems {
+		if !p.Warning {
+			count++
+		}
+	}
+
+	return count
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+func indexPath(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+type jsonField struct {
+	name string
+	typ  reflect.Type
+}
+
+// jsonFields lists the keys a struct decodes, the same way encoding/json
+// does, including the fields of embedded structs.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, jsonFields(ft)...)
+				continue
+			}
+		}
+
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{name: name, typ: f.Type})
+	}
+
+	return fields
+}
+
+// lookupField finds the field a key decodes into, preferring an exact match
+// but falling back to a case-insensitive one like encoding/json.
+func lookupField(fields []jsonField, key string) (reflect.Type, bool) {
+	for _, f := range fields {
+		if f.name == key {
+			return f.typ, true
+		}
+	}
+
+	for _, f := range fields {
+		if strings.EqualFold(f.name, key) {
+			return f.typ, true
+		}
+	}
+
+	return nil, false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// checkKeys reports every key in the raw config that doesn't decode into
+// anything in t, which encoding/json silently ignores.
+func (v *configValidator) checkKeys(raw interface{}, t reflect.Type, path string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	// Types that decode themselves, e.g. durations, times and log levels.
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			return
+		}
+
+		fields := jsonFields(t)
+		for _, key := range sortedKeys(object) {
+			ft, ok := lookupField(fields, key)
+			if !ok {
+				v.errorf(joinPath(path, key), "unknown key")
+				continue
+			}
+			v.checkKeys(object[key], ft, joinPath(path, key))
+		}
+	case reflect.Map:
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			return
+		}
+
+		for _, key := range sortedKeys(object) {
+			v.checkKeys(object[key], t.Elem(), joinPath(path, key))
+		}
+	case reflect.Slice, reflect.Array:
+		array, ok := raw.([]interface{})
+		if !ok {
+			return
+		}
+
+		for i, value := range array {
+			v.checkKeys(value, t.Elem(), indexPath(path, i))
+		}
+	}
+}
+
+var templatePlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// checkTemplate checks value only uses the {tag} placeholder. Keys shared by
+// every server in redis or on disk should include it, so servers don't
+// overwrite each other.
+func (v *configValidator) checkTemplate(path string, value string, perServer bool) {
+	for _, placeholder := range templatePlaceholder.FindAllString(value, -1) {
+		if placeholder != "{tag}" {
+			v.errorf(path, "unknown placeholder %s, only {tag} is supported", placeholder)
+		}
+	}
+
+	if perServer && value != "" && !strings.Contains(value, "{tag}") {
+		v.warnf(path, "%q doesn't include {tag}, every server using it will share it", value)
+	}
+}
+
+func (v *configValidator) checkPort(path string, port int) {
+	if port < 1 || port > 65535 {
+		v.errorf(path, "port must be between 1 and 65535, found %d", port)
+	}
+}
+
+func (v *configValidator) checkSchedule(path string, interval scheduler.Duration, schedule ScheduleConfig, allowZero bool) {
+	if interval < 0 || (interval == 0 && !allowZero) {
+		v.errorf(joinPath(path, "interval"), "interval must be greater than 0, found %s", interval)
+	}
+
+	if schedule.Offset < 0 {
+		v.errorf(joinPath(path, "offset"), "offset can't be negative")
+	}
+
+	if schedule.Jitter < 0 {
+		v.errorf(joinPath(path, "jitter"), "jitter can't be negative")
+	} else if interval > 0 && schedule.Jitter >= interval {
+		v.errorf(joinPath(path, "jitter"), "jitter must be less than the interval of %s, found %s", interval, schedule.Jitter)
+	}
+}
+
+func (v *configValidator) checkScript(path string, script string, disabled bool) {
+	if script == "" {
+		v.errorf(path, "script is required")
+		return
+	}
+
+	if disabled {
+		return
+	}
+
+	if err := stats.CheckScript(script); err != nil {
+		v.errorf(path, "%s", err)
+	}
+}
+
+func (v *configValidator) checkRegex(path string, pattern string) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		v.errorf(path, "%s", err)
+	}
+}
+
+func (v *configValidator) checkConnections(config *Config, sinks bool) {
+	if !config.EnableRedisQueue && !config.EnableInfluxStats && !sinks {
+		v.errorf("", "at least one of enable_redis_queue, enable_influx_stats or a sink must be enabled")
+	}
+
+	if usesRedis(config) {
+		if config.RedisConfig.Host == "" {
+			v.errorf("redis.hostname", "hostname is required when redis is used")
+		}
+		v.checkPort("redis.port", config.RedisConfig.Port)
+	}
+
+	if !config.EnableRedisQueue {
+		if len(config.IntervalCallbacks) > 0 {
+			v.warnf("interval_callbacks", "interval callbacks only run with enable_redis_queue")
+		}
+		if config.AlertsConfig.StateKey != "" {
+			v.warnf("alerts.state_key", "alert states are only written with enable_redis_queue")
+		}
+	} else if config.MaxQueueSize < 1 && (len(config.StaticQueues) > 0 || config.DynamicQueueKey != "") {
+		v.errorf("max_queue_size", "max_queue_size must be at least 1")
+	}
+
+	if config.EnableInfluxStats {
+		if config.InfluxConfig.Host == "" {
+			v.errorf("influx.hostname", "hostname is required with enable_influx_stats")
+		}
+		v.checkPort("influx.port", config.InfluxConfig.Port)
+		if config.InfluxConfig.Database == "" {
+			v.errorf("influx.database", "database is required with enable_influx_stats")
+		}
+	}
+
+	statsConfigured := len(config.StatsConfig.Internal) + len(config.StatsConfig.Invoked) + len(config.StatsConfig.Monitored)
+	if statsConfigured > 0 && !config.EnableInfluxStats && !sinks {
+		v.warnf("stats", "stats only run with enable_influx_stats or a sink enabled")
+	}
+}
+
+func (v *configValidator) checkTemplates(config *Config) {
+	v.checkTemplate("queues_prefix", config.QueuesPrefix, true)
+	v.checkTemplate("callback_queue_key", config.CallbackQueueKey, true)
+	v.checkTemplate("alerts.state_key", config.AlertsConfig.StateKey, true)
+	v.checkTemplate("globals.redis_key", config.GlobalsConfig.RedisKey, true)
+	v.checkTemplate("globals.path", config.GlobalsConfig.Path, true)
+	v.checkTemplate("sinks.file.path", config.SinksConfig.File.Path, true)
+	v.checkTemplate("sinks.file.rcon_log", config.SinksConfig.File.RconLog, true)
+	v.checkTemplate("sinks.redis_stream.key", config.SinksConfig.RedisStream.Key, true)
+
+	// The dynamic queue set is shared by every server, and isn't templated.
+	if strings.Contains(config.DynamicQueueKey, "{tag}") {
+		v.errorf("dynamic_queue_key", "{tag} isn't replaced in dynamic_queue_key, it's shared by every server")
+	}
+
+	for i, queue := range config.StaticQueues {
+		v.checkTemplate(indexPath("static_queues", i), queue, false)
+	}
+
+	for k, value := range config.DefaultTags {
+		v.checkTemplate(joinPath("default_tags", k), value, false)
+	}
+}
+
+func (v *configValidator) checkStats(config *Config) {
+	for i, cb := range config.IntervalCallbacks {
+		path := indexPath("interval_callbacks", i)
+		if cb.Command == "" {
+			v.errorf(joinPath(path, "command"), "command is required")
+		}
+		if cb.StorageKey == "" {
+			v.errorf(joinPath(path, "storage_key"), "storage_key is required")
+		}
+		v.checkTemplate(joinPath(path, "storage_key"), cb.StorageKey, true)
+		v.checkSchedule(path, cb.Interval, cb.ScheduleConfig, true)
+		if cb.Interval == 0 && !cb.RunOnConnect {
+			v.warnf(joinPath(path, "interval"), "interval is 0 and run_on_connect is off, this callback never runs")
+		}
+		if _, ok := rust.Parsers[strings.TrimSpace(cb.Command)]; cb.Parse && !ok {
+			v.errorf(joinPath(path, "parse"), "there's no parser for %s", cb.Command)
+		}
+
+		mode, err := middleware.ParseStorageMode(cb.Storage)
+		if err != nil {
+			v.errorf(joinPath(path, "storage"), "%s", err)
+		}
+		if mode == middleware.StorageHash && !cb.Parse && cb.Transform == "" {
+			v.errorf(joinPath(path, "storage"), "hash storage needs parse or a transform, the raw response has no fields")
+		}
+		if cb.TTL < 0 {
+			v.errorf(joinPath(path, "ttl"), "ttl can't be negative")
+		}
+		if cb.MaxLength < 0 {
+			v.errorf(joinPath(path, "max_length"), "max_length can't be negative")
+		} else if cb.MaxLength > 0 && mode != middleware.StorageList && mode != middleware.StorageZSet {
+			v.warnf(joinPath(path, "max_length"), "max_length only applies to list and zset storage")
+		}
+		if cb.Transform != "" {
+			if err := middleware.CheckTransform(cb.Transform); err != nil {
+				v.errorf(joinPath(path, "transform"), "%s", err)
+			}
+			if cb.Parse {
+				v.warnf(joinPath(path, "parse"), "parse is ignored with a transform, which can use the rust module itself")
+			}
+		}
+	}
+
+	for i, stat := range config.StatsConfig.Internal {
+		path := indexPath("stats.internal", i)
+		v.checkScript(joinPath(path, "script"), stat.Script, stat.Disabled)
+		v.checkSchedule(path, stat.Interval, stat.ScheduleConfig, false)
+	}
+
+	for i, stat := range config.StatsConfig.Invoked {
+		path := indexPath("stats.invoked", i)
+		if stat.Command == "" {
+			v.errorf(joinPath(path, "command"), "command is required")
+		}
+		v.checkScript(joinPath(path, "script"), stat.Script, stat.Disabled)
+		v.checkSchedule(path, stat.Interval, stat.ScheduleConfig, false)
+	}
+
+	for i, stat := range config.StatsConfig.Monitored {
+		path := indexPath("stats.monitored", i)
+		if stat.Pattern == "" {
+			v.errorf(joinPath(path, "pattern"), "pattern is required")
+			continue
+		}
+
+		_, err := stats.CheckMonitoredStat(stat.Pattern, stat.Script, stats.MonitoredStatOptions{
+			DotAll:      stat.DotAll,
+			Multiline:   stat.Multiline,
+			Measurement: stat.Measurement,
+			Tags:        stat.Tags,
+			Fields:      stat.Fields,
+		})
+		if err != nil {
+			v.errorf(path, "%s", err)
+		}
+
+		if stat.Script != "" {
+			v.checkScript(joinPath(path, "script"), stat.Script, stat.Disabled)
+		}
+	}
+
+	for i, aggregation := range config.StatsConfig.Aggregations {
+		if err := aggregation.Validate(); err != nil {
+			v.errorf(indexPath("stats.aggregations", i), "%s", err)
+		}
+	}
+}
+
+func (v *configValidator) checkAlerts(config *Config) {
+	for _, name := range sortedTargetNames(config.NotificationTargets) {
+		target := config.NotificationTargets[name]
+		if target == nil {
+			v.errorf(joinPath("notification_targets", name), "target is empty")
+			continue
+		}
+
+		// InitTarget compiles the template into the target, so check a copy.
+		check := *target
+		if err := check.InitTarget(name); err != nil {
+			v.errorf(joinPath("notification_targets", name), "%s", err)
+		}
+	}
+
+	for i, rule := range config.AlertsConfig.Rules {
+		path := indexPath("alerts.rules", i)
+		if err := rule.Validate(); err != nil {
+			v.errorf(joinPath(path, "expr"), "%s", err)
+		}
+
+		for j, target := range rule.Targets {
+			if _, ok := config.NotificationTargets[target]; !ok {
+				v.errorf(indexPath(joinPath(path, "targets"), j), "unknown notification target %s", target)
+			}
+		}
+	}
+}
+
+func sortedTargetNames(targets map[string]*stats.NotificationTarget) []string {
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (v *configValidator) checkMisc(config *Config) {
+	assembler := config.MessageAssembler
+	for i, header := range assembler.Headers {
+		v.checkRegex(indexPath("message_assembler.headers", i), header)
+	}
+	if assembler.Continuation != "" {
+		v.checkRegex("message_assembler.continuation", assembler.Continuation)
+	}
+	if assembler.Enabled && len(assembler.Headers) == 0 {
+		v.warnf("message_assembler.headers", "no headers are set, nothing will be assembled")
+	}
+	if assembler.WindowMs < 0 {
+		v.errorf("message_assembler.window_ms", "window_ms can't be negative")
+	}
+
+	if _, err := webrcon.ParseOverflowPolicy(config.OnMessageOverflow); err != nil {
+		v.errorf("onmessage_overflow", "%s", err)
+	}
+	if config.OnMessageBuffer < 0 {
+		v.errorf("onmessage_buffer", "onmessage_buffer can't be negative")
+	}
+
+	commands := make([]string, 0, len(config.CacheConfig))
+	for command := range config.CacheConfig {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		cache := config.CacheConfig[command]
+		path := joinPath("cache", command)
+		if cache.TTL <= 0 {
+			v.errorf(joinPath(path, "ttl"), "ttl must be positive")
+		}
+		if cache.StaleWhileRevalidate < 0 {
+			v.errorf(joinPath(path, "stale_while_revalidate"), "stale_while_revalidate can't be negative")
+		}
+	}
+
+	switch config.GlobalsConfig.Backend {
+	case "", "file", "redis":
+	default:
+		v.errorf("globals.backend", "unknown backend %s, must be one of file or redis", config.GlobalsConfig.Backend)
+	}
+
+	switch config.SinksConfig.File.Format {
+	case "", "jsonl", "csv":
+	default:
+		v.errorf("sinks.file.format", "unknown format %s, must be one of jsonl or csv", config.SinksConfig.File.Format)
+	}
+
+	if config.AdminConfig.Enabled && config.SinksConfig.Prometheus.Enabled &&
+		config.AdminConfig.Listen == config.SinksConfig.Prometheus.Listen {
+		v.errorf("admin.listen", "%s is already used by sinks.prometheus.listen", config.AdminConfig.Listen)
+	}
+
+	switch config.LoggingConfig.Encoding {
+	case "", "json", "console":
+	default:
+		v.errorf("logging.encoding", "unknown encoding %s, must be one of json or console", config.LoggingConfig.Encoding)
+	}
+}
+
+// validateConfig checks the decoded config, and the raw JSON it was decoded
+// from for unknown keys. Scripts are compiled relative to the working
+// directory, the same as at startup.
+func validateConfig(config *Config, raw interface{}) []configProblem {
+	v := &configValidator{}
+
+	v.checkKeys(raw, reflect.TypeOf(config), "")
+	v.checkConnections(config, len(buildSinks("validate", config)) > 0 || buildRconLog("validate", config) != nil)
+	v.checkTemplates(config)
+	v.checkStats(config)
+	v.checkAlerts(config)
+	v.checkMisc(config)
+
+	return v.problems
+}
+
+// reportProblems prints every problem, and returns the number of errors.
+func reportProblems(filename string, problems []configProblem) int {
+	v := configValidator{problems: problems}
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", filename, p)
+	}
+
+	errors := v.errors()
+	fmt.Printf("%s: %d error(s), %d warning(s)\n", filename, errors, len(problems)-errors)
+
+	return errors
+}
+
+// runValidate implements the validate subcommand, checking the config and
+// every script and pattern it uses. Returns the process exit code, non-zero
+// if there are any errors.
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := flags.String("config", "rustcon.conf", "Path to the configuration file, JSON, YAML or TOML")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s validate [options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	config, raw, err := readconfig(*configFile)
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		return 1
+	}
+
+	if reportProblems(*configFile, validateConfig(config, raw)) > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,285 @@
+package webrcon
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CachePolicy sets how long a command's responses are cached, overriding
+// whatever the caller asked for. Once TTL has passed a response is still
+// served for up to StaleWhileRevalidate longer, while the command is sent
+// again in the background to refresh it.
+type CachePolicy struct {
+	TTL                  time.Duration
+	StaleWhileRevalidate time.Duration
+}
+
+// Request is a command to send, and how it can be answered from the cache.
+type Request struct {
+	Command string
+	// CacheFor caches the response, unless the command has a CachePolicy.
+	CacheFor time.Duration
+	// Bypass always sends the command instead of using a cached response,
+	// though the response still refreshes the cache.
+	Bypass bool
+}
+
+// CacheEntry is a cached command response.
+type CacheEntry struct {
+	Command string    `json:"command"`
+	Cached  time.Time `json:"cached"`
+	TTL     string    `json:"ttl"`
+	Stale   string    `json:"stale_while_revalidate,omitempty"`
+	State   string    `json:"state"`
+}
+
+// CommandCacheStats are the cache stats of a single command. Stale hits were
+// answered with a stale response while it was refreshed, and shared requests
+// were answered by a request for the same command already in flight.
+type CommandCacheStats struct {
+	Command   string `json:"command"`
+	Hits      int64  `json:"hits"`
+	StaleHits int64  `json:"stale_hits"`
+	Misses    int64  `json:"misses"`
+	Shared    int64  `json:"shared"`
+	Bypassed  int64  `json:"bypassed"`
+}
+
+type cacheEntry struct {
+	response *Response
+	stored   time.Time
+	ttl      time.Duration
+	stale    time.Duration
+}
+
+// flight is a cacheable command waiting on its response, which every request
+// for the same command made meanwhile shares.
+type flight struct {
+	identifier int
+	ttl        time.Duration
+	stale      time.Duration
+	waiters    []func(response *Response)
+}
+
+func (entry *cacheEntry) state(now time.Time) string {
+	age := now.Sub(entry.stored)
+	switch {
+	case age < entry.ttl:
+		return "fresh"
+	case age < entry.ttl+entry.stale:
+		return "stale"
+	}
+
+	return "expired"
+}
+
+// cachePolicy returns how long the response to the request is cached for.
+func (client *RconClient) cachePolicy(req Request) (time.Duration, time.Duration) {
+	if policy, ok := client.CachePolicies[req.Command]; ok {
+		return policy.TTL, policy.StaleWhileRevalidate
+	}
+
+	return req.CacheFor, 0
+}
+
+// commandStats returns the cache stats of command, the cache lock must be
+// held.
+func (client *RconClient) commandStats(command string) *CommandCacheStats {
+	stats, ok := client.cacheStats[command]
+	if !ok {
+		stats = &CommandCacheStats{Command: command}
+		client.cacheStats[command] = stats
+	}
+
+	return stats
+}
+
+// SendRequest sends a command, answering it from the cache when it can. A
+// fresh cached response is used as is, and a stale one is used while the
+// command is sent again to refresh it. Otherwise a request for a command
+// that's already in flight waits for that response instead of sending it
+// again.
+func (client *RconClient) SendRequest(req Request, callback func(response *Response)) {
+	ttl, stale := client.cachePolicy(req)
+	command := req.Command
+
+	client.cachemu.Lock()
+	stats := client.commandStats(command)
+
+	if req.Bypass {
+		stats.Bypassed++
+	} else if entry, ok := client.cache[command]; ok {
+		switch entry.state(time.Now()) {
+		case "fresh":
+			stats.Hits++
+			client.cachemu.Unlock()
+			atomic.AddInt64(&client.stats.CacheHits, 1)
+			client.runCallback(command, callback, entry.response)
+			return
+		case "stale":
+			stats.StaleHits++
+			refresh := client.inflight[command] == nil
+			var f *flight
+			if refresh {
+				f = &flight{ttl: ttl, stale: stale}
+				client.inflight[command] = f
+			}
+			client.cachemu.Unlock()
+			atomic.AddInt64(&client.stats.CacheHits, 1)
+			client.runCallback(command, callback, entry.response)
+			if refresh {
+				zap.S().Debugf("Refreshing stale cached response to %s", command)
+				client.sendFlight(command, f)
+			}
+			return
+		default:
+			delete(client.cache, command)
+		}
+	}
+
+	if !req.Bypass {
+		stats.Misses++
+		atomic.AddInt64(&client.stats.CacheMisses, 1)
+
+		if f, ok := client.inflight[command]; ok {
+			stats.Shared++
+			f.waiters = append(f.waiters, callback)
+			client.cachemu.Unlock()
+			return
+		}
+	}
+
+	// Only cacheable commands are shared, so commands with side effects are
+	// always sent.
+	if ttl <= 0 {
+		client.cachemu.Unlock()
+		client.sendCommand(command, callback)
+		return
+	}
+
+	f := &flight{ttl: ttl, stale: stale, waiters: []func(response *Response){callback}}
+	if _, ok := client.inflight[command]; !ok {
+		client.inflight[command] = f
+	}
+	client.cachemu.Unlock()
+
+	client.sendFlight(command, f)
+}
+
+// sendFlight sends the command of a flight, caching the response and passing
+// it to every request waiting on it.
+func (client *RconClient) sendFlight(command string, f *flight) {
+	identifier, ok := client.sendCommand(command, func(response *Response) {
+		client.cachemu.Lock()
+		if client.inflight[command] == f {
+			delete(client.inflight, command)
+		}
+		client.cache[command] = &cacheEntry{
+			response: response,
+			stored:   time.Now(),
+			ttl:      f.ttl,
+			stale:    f.stale,
+		}
+		waiters := f.waiters
+		client.cachemu.Unlock()
+
+		for _, waiter := range waiters {
+			client.runCallback(command, waiter, response)
+		}
+	})
+
+	if ok {
+		client.cachemu.Lock()
+		f.identifier = identifier
+		client.cachemu.Unlock()
+		return
+	}
+
+	client.dropFlight(command, f, "it couldn't be sent")
+}
+
+// abandonFlight stops requests waiting on a command that timed out, so the
+// next request sends it again.
+func (client *RconClient) abandonFlight(command string, identifier int) {
+	client.cachemu.Lock()
+	f, ok := client.inflight[command]
+	ok = ok && f.identifier == identifier
+	client.cachemu.Unlock()
+
+	if ok {
+		client.dropFlight(command, f, "it timed out")
+	}
+}
+
+// dropFlight removes a flight that will never get a response, so the next
+// request sends the command again. The requests waiting on it are dropped,
+// the same as the callback of a command that isn't answered.
+func (client *RconClient) dropFlight(command string, f *flight, reason string) {
+	client.cachemu.Lock()
+	if client.inflight[command] == f {
+		delete(client.inflight, command)
+	}
+	waiters := len(f.waiters)
+	client.cachemu.Unlock()
+
+	if waiters > 0 {
+		zap.S().Warnf("Dropping %d requests waiting on the response to %s, %s.", waiters, command, reason)
+	}
+}
+
+// invalidateCache drops every cached response and flight, e.g. on reconnect
+// when the server may have restarted.
+func (client *RconClient) invalidateCache() {
+	client.cachemu.Lock()
+	defer client.cachemu.Unlock()
+
+	client.cache = make(map[string]*cacheEntry)
+	client.inflight = make(map[string]*flight)
+}
+
+// CacheEntries returns the cached command responses, sorted by command.
+// Expired entries are only removed on the next request for the command.
+func (client *RconClient) CacheEntries() []CacheEntry {
+	client.cachemu.Lock()
+	defer client.cachemu.Unlock()
+
+	now := time.Now()
+	entries := make([]CacheEntry, 0, len(client.cache))
+	for command, entry := range client.cache {
+		e := CacheEntry{
+			Command: command,
+			Cached:  entry.stored,
+			TTL:     entry.ttl.String(),
+			State:   entry.state(now),
+		}
+		if entry.stale > 0 {
+			e.Stale = entry.stale.String()
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, k int) bool {
+		return entries[i].Command < entries[k].Command
+	})
+
+	return entries
+}
+
+func (client *RconClient) commandCacheStats() []CommandCacheStats {
+	client.cachemu.Lock()
+	defer client.cachemu.Unlock()
+
+	stats := make([]CommandCacheStats, 0, len(client.cacheStats))
+	for _, s := range client.cacheStats {
+		stats = append(stats, *s)
+	}
+
+	sort.Slice(stats, func(i, k int) bool {
+		return stats[i].Command < stats[k].Command
+	})
+
+	return stats
+}
@@ -3,8 +3,10 @@ package webrcon
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,47 +18,58 @@ const (
 	StartingIdentifier = 1000
 )
 
-// RconStats holds various stats about the operation of the RCON client.
+// RconStats holds various stats about the operation of the RCON client. The
+// client's own counters are only updated atomically, use StatsSnapshot to read
+// them. Subscribers and Cache are left out of the map passed to scripts, which
+// only holds the counters.
 type RconStats struct {
-	CommandsRun        int
-	CommandTimeouts    int
-	Disconnects        int
-	Messages           int
-	CacheHits          int
-	CacheMisses        int
-	OnConnectCallback  int
-	OnMessageCallbacks int
-	OnInvokeCallbacks  int
+	CommandsRun        int64
+	CommandTimeouts    int64
+	Disconnects        int64
+	Messages           int64
+	CacheHits          int64
+	CacheMisses        int64
+	OnConnectCallback  int64
+	OnMessageCallbacks int64
+	OnInvokeCallbacks  int64
+	Subscribers        []SubscriberStats   `structs:"-"`
+	Cache              []CommandCacheStats `structs:"-"`
 }
 
 // RconClient maintains the connection to the Rust server.
 type RconClient struct {
-	Connected               bool
+	// Counters are first to keep them 64-bit aligned for atomic access.
+	stats                   RconStats
+	connected               int32
 	CallOnMessageOnInvoke   bool
 	IgnoreEmptyRconMessages bool
 	OnConnectDelay          int
-	Stats                   RconStats
+	MessageBuffer           int
+	Overflow                OverflowPolicy
+	Recorder                *Recorder
+	CachePolicies           map[string]CachePolicy
 	identifier              int
 	rconPath                string
 	con                     *websocket.Conn
 	callbacks               map[int]RconCallback
+	running                 map[int64]runningCallback
+	runningID               int64
 	onconnect               []OnConnectCallback
-	onmessage               []OnMessageCallback
+	onmessage               []*subscriber
+	onreceive               []OnMessageCallback
 	mu                      sync.Mutex // So many mutexes, there must be a better
 	cmu                     sync.Mutex // way..
 	cachemu                 sync.Mutex
 	dcmu                    sync.Mutex
-	cache                   map[string]commandCache
-}
-
-type commandCache struct {
-	ttl       int
-	timestamp int64
-	response  *Response
+	cache                   map[string]*cacheEntry
+	inflight                map[string]*flight
+	cacheStats              map[string]*CommandCacheStats
+	replay                  *replaySession
 }
 
 // OnMessageCallback contains the callbacks run on every RCON message
 type OnMessageCallback struct {
+	Name     string
 	Callback func(message []byte)
 }
 
@@ -69,28 +82,82 @@ type OnConnectCallback struct {
 // RconCallback struct contains the information about a registered callback,
 // and its TTL
 type RconCallback struct {
+	command   string
 	ttl       int
 	timestamp int64
 	callback  func(response *Response)
 }
 
-func (client *RconClient) checkCache(command string) *Response {
-	client.cachemu.Lock()
-	defer client.cachemu.Unlock()
+// PendingCallback is a command still waiting on its response.
+type PendingCallback struct {
+	Identifier int       `json:"identifier"`
+	Command    string    `json:"command"`
+	Sent       time.Time `json:"sent"`
+	Age        string    `json:"age"`
+}
 
-	if cacheData, ok := client.cache[command]; ok {
-		if time.Now().Unix()-cacheData.timestamp >= int64(cacheData.ttl) {
-			delete(client.cache, command)
-			client.Stats.CacheMisses++
-			return nil
-		}
+// Connected returns whether the client is connected to the server.
+func (client *RconClient) Connected() bool {
+	return atomic.LoadInt32(&client.connected) == 1
+}
 
-		client.Stats.CacheHits++
-		return cacheData.response
+func (client *RconClient) setConnected(connected bool) {
+	var v int32
+	if connected {
+		v = 1
 	}
+	atomic.StoreInt32(&client.connected, v)
+}
 
-	client.Stats.CacheMisses++
-	return nil
+// StatsSnapshot returns a copy of the client's counters.
+func (client *RconClient) StatsSnapshot() RconStats {
+	return RconStats{
+		CommandsRun:        atomic.LoadInt64(&client.stats.CommandsRun),
+		CommandTimeouts:    atomic.LoadInt64(&client.stats.CommandTimeouts),
+		Disconnects:        atomic.LoadInt64(&client.stats.Disconnects),
+		Messages:           atomic.LoadInt64(&client.stats.Messages),
+		CacheHits:          atomic.LoadInt64(&client.stats.CacheHits),
+		CacheMisses:        atomic.LoadInt64(&client.stats.CacheMisses),
+		OnConnectCallback:  atomic.LoadInt64(&client.stats.OnConnectCallback),
+		OnMessageCallbacks: atomic.LoadInt64(&client.stats.OnMessageCallbacks),
+		OnInvokeCallbacks:  atomic.LoadInt64(&client.stats.OnInvokeCallbacks),
+		Subscribers:        client.subscriberStats(),
+		Cache:              client.commandCacheStats(),
+	}
+}
+
+func (client *RconClient) subscriberStats() []SubscriberStats {
+	stats := make([]SubscriberStats, 0, len(client.onmessage))
+	for _, s := range client.onmessage {
+		stats = append(stats, s.stats())
+	}
+
+	return stats
+}
+
+// PendingCallbacks returns the commands still waiting on a response, oldest
+// first.
+func (client *RconClient) PendingCallbacks() []PendingCallback {
+	client.cmu.Lock()
+	defer client.cmu.Unlock()
+
+	now := time.Now()
+	pending := make([]PendingCallback, 0, len(client.callbacks))
+	for id, cb := range client.callbacks {
+		sent := time.Unix(cb.timestamp, 0)
+		pending = append(pending, PendingCallback{
+			Identifier: id,
+			Command:    cb.command,
+			Sent:       sent,
+			Age:        now.Sub(sent).Truncate(time.Second).String(),
+		})
+	}
+
+	sort.Slice(pending, func(i, k int) bool {
+		return pending[i].Identifier < pending[k].Identifier
+	})
+
+	return pending
 }
 
 // InitClient sets up the RconClient
@@ -100,9 +167,11 @@ func (client *RconClient) InitClient(host string, port int, password string) {
 	// Default initial identifier value
 	client.identifier = StartingIdentifier
 	client.callbacks = make(map[int]RconCallback)
-	client.cache = make(map[string]commandCache)
-	client.Connected = false
-	client.Stats = RconStats{}
+	client.running = make(map[int64]runningCallback)
+	client.cache = make(map[string]*cacheEntry)
+	client.inflight = make(map[string]*flight)
+	client.cacheStats = make(map[string]*CommandCacheStats)
+	client.setConnected(false)
 
 	zap.S().Infof("Initialized RCON client to %s:%d", host, port)
 }
@@ -119,7 +188,7 @@ func (client *RconClient) MaintainConnection(done chan struct{}, wg *sync.WaitGr
 		case <-done:
 			zap.S().Info("Shutting down RCON client.")
 			wg.Done()
-			if client.Connected {
+			if client.Connected() {
 				// This should interrupt the read on the rconReader goroutine
 				client.disconnect()
 			}
@@ -127,7 +196,7 @@ func (client *RconClient) MaintainConnection(done chan struct{}, wg *sync.WaitGr
 		default:
 		}
 
-		if client.Connected {
+		if client.Connected() {
 			time.Sleep(5 * time.Second)
 			continue
 		}
@@ -144,14 +213,48 @@ func (client *RconClient) MaintainConnection(done chan struct{}, wg *sync.WaitGr
 	}
 }
 
+// Connect connects once and starts reading messages, without retrying, for
+// short lived clients like the console. MaintainConnection can still be run
+// afterwards to reconnect whenever the connection drops.
+func (client *RconClient) Connect(done chan struct{}, wg *sync.WaitGroup) error {
+	if err := client.connect(); err != nil {
+		return err
+	}
+
+	go client.rconReader(done, wg)
+
+	return nil
+}
+
+// Disconnect closes the connection, if it's open.
+func (client *RconClient) Disconnect() {
+	if client.Connected() {
+		client.disconnect()
+	}
+}
+
 // OnConnect registers a callback to be called on connect.
 func (client *RconClient) OnConnect(cb OnConnectCallback) {
 	client.onconnect = append(client.onconnect, cb)
 }
 
-// OnMessage registers a callback to be called on every raw rcon message
+// OnMessage registers a callback to be called on every raw rcon message. Each
+// callback gets messages in the order they arrive, from its own goroutine,
+// buffering up to MessageBuffer of them. Once the buffer is full, Overflow
+// decides whether to wait or drop one.
 func (client *RconClient) OnMessage(cb OnMessageCallback) {
-	client.onmessage = append(client.onmessage, cb)
+	if cb.Name == "" {
+		cb.Name = fmt.Sprintf("onmessage-%d", len(client.onmessage))
+	}
+
+	client.onmessage = append(client.onmessage, newSubscriber(cb, client.MessageBuffer, client.Overflow))
+}
+
+// OnReceive registers a callback to be called with every message received,
+// including command responses. Unlike OnMessage callbacks these are called in
+// the order messages arrive, on the reader goroutine, so they must not block.
+func (client *RconClient) OnReceive(cb OnMessageCallback) {
+	client.onreceive = append(client.onreceive, cb)
 }
 
 func (client *RconClient) runOnConnectCB(cb OnConnectCallback) {
@@ -168,11 +271,17 @@ func (client *RconClient) connect() error {
 	if err != nil {
 		return fmt.Errorf("Error connecting to RCON: %s", err)
 	}
+	client.mu.Lock()
 	client.con = con
-	client.Connected = true
+	client.mu.Unlock()
+
+	// The server may have restarted, so nothing cached before can be trusted,
+	// and nothing in flight will be answered.
+	client.invalidateCache()
+	client.setConnected(true)
 
 	for _, v := range client.onconnect {
-		client.Stats.OnConnectCallback++
+		atomic.AddInt64(&client.stats.OnConnectCallback, 1)
 		go client.runOnConnectCB(v)
 	}
 
@@ -184,83 +293,108 @@ func (client *RconClient) disconnect() {
 	client.dcmu.Lock()
 	defer client.dcmu.Unlock()
 
-	if !client.Connected {
+	if !client.Connected() {
 		zap.S().Warn("Attempting to disconnect an already disconnected connection.")
 		return
 	}
 
-	client.Stats.Disconnects++
+	atomic.AddInt64(&client.stats.Disconnects, 1)
 
 	zap.S().Info("Disconnecting RCON client")
-	err := client.con.Close()
+	err := client.conn().Close()
 	if err != nil {
 		zap.S().Warnf("Error closing connection: %s", err)
 	}
 
-	client.Connected = false
+	client.setConnected(false)
 }
 
-func (client *RconClient) writeJSON(v interface{}) error {
+// conn returns the current websocket connection.
+func (client *RconClient) conn() *websocket.Conn {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 
-	return client.con.WriteJSON(v)
+	return client.con
 }
 
-func (client *RconClient) cacheWrapper(command string, cacheFor int, cb func(response *Response)) func(response *Response) {
-	return func(response *Response) {
-		if cacheFor > 0 {
-			client.cachemu.Lock()
-			client.cache[command] = commandCache{
-				timestamp: time.Now().Unix(),
-				ttl:       cacheFor,
-				response:  response,
-			}
-			client.cachemu.Unlock()
-		}
-		cb(response)
+func (client *RconClient) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
 	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.Recorder != nil {
+		client.Recorder.Record(FrameOut, data)
+	}
+
+	return client.con.WriteMessage(websocket.TextMessage, data)
 }
 
-// SendCallback sends a command with a callback
+// SendCallback sends a command with a callback, caching the response for
+// cacheFor seconds.
 func (client *RconClient) SendCallback(command string, cacheFor int, callback func(response *Response)) {
-	// Short-circuit the whole process, callback on the cached results.
-	cacheData := client.checkCache(command)
-	if cacheData != nil {
-		go callback(cacheData)
-		return
+	client.SendRequest(Request{
+		Command:  command,
+		CacheFor: time.Duration(cacheFor) * time.Second,
+	}, callback)
+}
+
+// sendCommand sends a command, registering its callback. Returns the
+// command's identifier, or false if it wasn't sent.
+func (client *RconClient) sendCommand(command string, callback func(response *Response)) (int, bool) {
+	if replay := client.replaySession(); replay != nil {
+		return client.replayCommand(replay, command, callback)
 	}
 
-	if !client.Connected {
+	if !client.Connected() {
 		zap.S().Info("Client is disconnected, unable to send command.")
-		return
+		return 0, false
 	}
 
 	client.cmu.Lock()
 	client.identifier++
-	zap.S().Debugf("Set ID to %d for callback.", client.identifier)
+	identifier := client.identifier
+	zap.S().Debugf("Set ID to %d for callback.", identifier)
 
 	cmd := Command{
-		Identifier: client.identifier,
+		Identifier: identifier,
 		Message:    command,
 		Name:       "WebRcon"}
 
 	cb := RconCallback{
+		command:   command,
 		ttl:       10,
 		timestamp: time.Now().Unix(),
-		callback:  client.cacheWrapper(command, cacheFor, callback)}
+		callback:  callback}
 
-	client.callbacks[client.identifier] = cb
+	client.callbacks[identifier] = cb
 	client.cmu.Unlock()
 
-	client.writeJSON(&cmd)
+	if err := client.writeJSON(&cmd); err != nil {
+		zap.S().Errorf("Error sending command %s: %s", command, err)
+
+		client.cmu.Lock()
+		delete(client.callbacks, identifier)
+		client.cmu.Unlock()
+		return 0, false
+	}
 
-	client.Stats.CommandsRun++
+	atomic.AddInt64(&client.stats.CommandsRun, 1)
+
+	return identifier, true
 }
 
 // Send a command with no callback
 func (client *RconClient) Send(command string) {
-	if !client.Connected {
+	if client.replaySession() != nil {
+		zap.S().Debugf("REPLAY: Not sending %s", command)
+		return
+	}
+
+	if !client.Connected() {
 		zap.S().Info("Client is disconnected, unable to send command.")
 		return
 	}
@@ -272,16 +406,18 @@ func (client *RconClient) Send(command string) {
 
 	client.writeJSON(&cmd)
 
-	client.Stats.CommandsRun++
+	atomic.AddInt64(&client.stats.CommandsRun, 1)
 }
 
 func (client *RconClient) rconReader(done chan struct{}, wg *sync.WaitGroup) {
-	var sendOnMessage bool = true
 	defer wg.Done()
 
 	zap.S().Debug("Starting up RCON reader")
 	wg.Add(1)
 
+	// The reader only ever reads the connection it was started for.
+	con := client.conn()
+
 	for {
 		select {
 		case <-done:
@@ -290,79 +426,102 @@ func (client *RconClient) rconReader(done chan struct{}, wg *sync.WaitGroup) {
 		default:
 		}
 
-		_, message, err := client.con.ReadMessage()
+		_, message, err := con.ReadMessage()
 
 		if err != nil {
 			zap.S().Errorf("RCON Read Error! Disconnecting from RCON. Error: %s", err)
-			if client.Connected {
+			if client.Connected() {
 				client.disconnect()
 			}
 
 			return
 		}
 
-		client.Stats.Messages++
-		zap.S().Debug("Received RCON message: ", string(message))
+		if client.Recorder != nil {
+			client.Recorder.Record(FrameIn, message)
+		}
 
-		var p Response
+		client.handleMessage(message)
+	}
+}
 
-		if err := json.Unmarshal(message, &p); err != nil {
-			zap.S().Errorf("Error decoding RCON websocket response: %s", err)
-			continue
-		}
+// handleMessage dispatches a single message received from the server to the
+// command callbacks and the OnMessage callbacks, and expires any command
+// callbacks that have timed out.
+func (client *RconClient) handleMessage(message []byte) {
+	sendOnMessage := true
 
-		zap.S().Debugf("Registered invoke callbacks: %+v", client.callbacks)
+	atomic.AddInt64(&client.stats.Messages, 1)
+	zap.S().Debug("Received RCON message: ", string(message))
 
-		if p.Identifier >= StartingIdentifier {
-			sendOnMessage = client.CallOnMessageOnInvoke
+	for _, v := range client.onreceive {
+		v.Callback(message)
+	}
 
-			zap.S().Debugf("Received RCON ID %d.", p.Identifier)
+	var p Response
+
+	if err := json.Unmarshal(message, &p); err != nil {
+		zap.S().Errorf("Error decoding RCON websocket response: %s", err)
+		return
+	}
+
+	if p.Identifier >= StartingIdentifier {
+		sendOnMessage = client.CallOnMessageOnInvoke
+
+		zap.S().Debugf("Received RCON ID %d.", p.Identifier)
+
+		client.cmu.Lock()
+		zap.S().Debugf("Registered invoke callbacks: %+v", client.callbacks)
+		if val, exists := client.callbacks[p.Identifier]; exists {
+			client.cmu.Unlock()
+			zap.S().Debugf("Calling callback %+v for ID %d", val, p.Identifier)
+			atomic.AddInt64(&client.stats.OnInvokeCallbacks, 1)
+			client.runCallback(val.command, val.callback, &p)
 
 			client.cmu.Lock()
-			if val, exists := client.callbacks[p.Identifier]; exists {
-				client.cmu.Unlock()
-				zap.S().Debugf("Calling callback %+v for ID %d", val, p.Identifier)
-				client.Stats.OnInvokeCallbacks++
-				go val.callback(&p)
-
-				client.cmu.Lock()
-				delete(client.callbacks, p.Identifier)
-				client.cmu.Unlock()
+			delete(client.callbacks, p.Identifier)
+			client.cmu.Unlock()
+		} else {
+			client.cmu.Unlock()
+			if client.IgnoreEmptyRconMessages && strings.TrimSpace(p.Message) == "" {
+				zap.S().Debugf("No callback found for %d, message was empty.", p.Identifier)
 			} else {
-				client.cmu.Unlock()
-				if client.IgnoreEmptyRconMessages && strings.TrimSpace(p.Message) == "" {
-					zap.S().Debugf("No callback found for %d, message was empty.", p.Identifier)
-				} else {
-					zap.S().Errorf("No callback found for %d, this shouldn't happen. Message: %s", p.Identifier, p.Message)
-				}
+				zap.S().Errorf("No callback found for %d, this shouldn't happen. Message: %s", p.Identifier, p.Message)
 			}
-		} else {
-			sendOnMessage = true
 		}
+	}
 
-		if sendOnMessage {
-			for _, v := range client.onmessage {
-				client.Stats.OnMessageCallbacks++
-				go v.Callback(message)
-			}
+	if sendOnMessage {
+		for _, v := range client.onmessage {
+			atomic.AddInt64(&client.stats.OnMessageCallbacks, 1)
+			v.deliver(message)
 		}
+	}
 
-		client.cmu.Lock()
-		for i, v := range client.callbacks {
-			if v.ttl <= 0 {
-				continue
-			}
+	var expired []RconCallback
+	var expiredIDs []int
 
-			if time.Now().Unix()-v.timestamp >= int64(v.ttl) {
-				// Maybe change this to Debugf, but for now I think its worth
-				// notifying in normal logging when callbacks expire. Its normal
-				// to happen under high load or during initial connect.
-				zap.S().Infof("Expiring callback ID %d, timed out.", i)
+	client.cmu.Lock()
+	for i, v := range client.callbacks {
+		if v.ttl <= 0 {
+			continue
+		}
 
-				delete(client.callbacks, i)
-				client.Stats.CommandTimeouts++
-			}
+		if time.Now().Unix()-v.timestamp >= int64(v.ttl) {
+			// Maybe change this to Debugf, but for now I think its worth
+			// notifying in normal logging when callbacks expire. Its normal
+			// to happen under high load or during initial connect.
+			zap.S().Infof("Expiring callback ID %d, timed out.", i)
+
+			delete(client.callbacks, i)
+			atomic.AddInt64(&client.stats.CommandTimeouts, 1)
+			expired = append(expired, v)
+			expiredIDs = append(expiredIDs, i)
 		}
-		client.cmu.Unlock()
+	}
+	client.cmu.Unlock()
+
+	for i, v := range expired {
+		client.abandonFlight(v.command, expiredIDs[i])
 	}
 }
@@ -0,0 +1,320 @@
+package webrcon
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeServer speaks enough WebRCON for the client: it answers every command
+// with "response to <command>", and streams console messages in between.
+type fakeServer struct {
+	// Counters are first to keep them 64-bit aligned for atomic access.
+	commands int64
+	password string
+	mu       sync.Mutex
+	conns    []*websocket.Conn
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimPrefix(r.URL.Path, "/") != s.password {
+		http.Error(w, "bad password", http.StatusUnauthorized)
+		return
+	}
+
+	upgrader := websocket.Upgrader{}
+	con, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.conns = append(s.conns, con)
+	s.mu.Unlock()
+
+	// gorilla/websocket allows a single writer per connection.
+	var wmu sync.Mutex
+	write := func(v interface{}) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		return con.WriteJSON(v)
+	}
+
+	closed := make(chan struct{})
+	defer close(closed)
+
+	go func() {
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+				if write(Response{Message: "console line", Type: "Generic"}) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		var cmd Command
+		if err := con.ReadJSON(&cmd); err != nil {
+			return
+		}
+		atomic.AddInt64(&s.commands, 1)
+
+		if cmd.Identifier < 0 {
+			continue
+		}
+		if write(Response{Identifier: cmd.Identifier, Message: "response to " + cmd.Message, Type: "Generic"}) != nil {
+			return
+		}
+	}
+}
+
+// kick drops every open connection, as a server restart would.
+func (s *fakeServer) kick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, con := range s.conns {
+		con.Close()
+	}
+	s.conns = nil
+}
+
+func startFakeServer(t *testing.T) (*fakeServer, string, int) {
+	t.Helper()
+
+	server := &fakeServer{password: "secret"}
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, host, p
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestClientStress uses the client from many goroutines at once, while the
+// server drops the connection a few times. Run it with -race.
+func TestClientStress(t *testing.T) {
+	server, host, port := startFakeServer(t)
+
+	client := &RconClient{
+		MessageBuffer: 16,
+		Overflow:      OverflowDropOldest,
+		CachePolicies: map[string]CachePolicy{
+			"playerlist": {TTL: 5 * time.Millisecond, StaleWhileRevalidate: 5 * time.Millisecond},
+		},
+	}
+	client.InitClient(host, port, server.password)
+
+	var received, consumed, responses, mismatched int64
+	client.OnReceive(OnMessageCallback{Callback: func(message []byte) {
+		atomic.AddInt64(&received, 1)
+	}})
+	client.OnMessage(OnMessageCallback{Name: "slow", Callback: func(message []byte) {
+		atomic.AddInt64(&consumed, 1)
+		time.Sleep(50 * time.Microsecond)
+	}})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		client.Disconnect()
+	}()
+
+	if err := client.Connect(done, &wg); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(command string) func(response *Response) {
+		return func(response *Response) {
+			atomic.AddInt64(&responses, 1)
+			if response.Message != "response to "+command {
+				atomic.AddInt64(&mismatched, 1)
+			}
+		}
+	}
+
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		workers.Add(1)
+		go func(worker int) {
+			defer workers.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				command := fmt.Sprintf("command %d-%d", worker, n)
+				client.SendCallback(command, 0, check(command))
+				client.SendRequest(Request{Command: "playerlist"}, check("playerlist"))
+				client.SendRequest(Request{Command: "serverinfo", CacheFor: time.Millisecond, Bypass: n%2 == 0}, check("serverinfo"))
+				client.Send("say hello")
+
+				_ = client.Connected()
+				_ = client.StatsSnapshot()
+				_ = client.PendingCallbacks()
+				_ = client.CacheEntries()
+				time.Sleep(100 * time.Microsecond)
+			}
+		}(i)
+	}
+
+	const reconnects = 3
+	for i := 0; i < reconnects; i++ {
+		time.Sleep(100 * time.Millisecond)
+		server.kick()
+		waitFor(t, "the client to notice the disconnect", func() bool { return !client.Connected() })
+
+		if err := client.Connect(done, &wg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	workers.Wait()
+
+	if !client.Connected() {
+		t.Error("client isn't connected after reconnecting")
+	}
+
+	stats := client.StatsSnapshot()
+	if stats.Disconnects != reconnects {
+		t.Errorf("Disconnects = %d, want %d", stats.Disconnects, reconnects)
+	}
+	if atomic.LoadInt64(&responses) == 0 {
+		t.Error("no command got a response")
+	}
+	if n := atomic.LoadInt64(&mismatched); n != 0 {
+		t.Errorf("%d callbacks got the response to another command", n)
+	}
+	if r, c := atomic.LoadInt64(&received), atomic.LoadInt64(&consumed); r == 0 || c == 0 {
+		t.Errorf("messages weren't delivered, received %d, consumed %d", r, c)
+	}
+	if atomic.LoadInt64(&server.commands) == 0 {
+		t.Error("the server got no commands")
+	}
+
+	for _, s := range stats.Subscribers {
+		if s.Name == "slow" && s.Lag > client.MessageBuffer {
+			t.Errorf("subscriber lag %d is over its buffer of %d", s.Lag, client.MessageBuffer)
+		}
+	}
+}
+
+// TestSingleFlight checks concurrent requests for a cacheable command share a
+// single command sent to the server.
+func TestSingleFlight(t *testing.T) {
+	server, host, port := startFakeServer(t)
+
+	client := &RconClient{}
+	client.InitClient(host, port, server.password)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		client.Disconnect()
+	}()
+
+	if err := client.Connect(done, &wg); err != nil {
+		t.Fatal(err)
+	}
+
+	const requests = 50
+	var answered sync.WaitGroup
+	answered.Add(requests)
+
+	start := make(chan struct{})
+	for i := 0; i < requests; i++ {
+		go func() {
+			<-start
+			client.SendRequest(Request{Command: "playerlist", CacheFor: time.Minute}, func(response *Response) {
+				answered.Done()
+			})
+		}()
+	}
+	close(start)
+	answered.Wait()
+
+	if got := atomic.LoadInt64(&server.commands); got != 1 {
+		t.Errorf("server got %d commands, want 1", got)
+	}
+
+	stats := client.StatsSnapshot()
+	if len(stats.Cache) != 1 || stats.Cache[0].Hits+stats.Cache[0].Shared != requests-1 {
+		t.Errorf("cache stats = %+v, want %d hits or shared requests", stats.Cache, requests-1)
+	}
+}
+
+// TestFailedFlight checks a cacheable command that couldn't be sent doesn't
+// leave later requests waiting on it.
+func TestFailedFlight(t *testing.T) {
+	server, host, port := startFakeServer(t)
+
+	client := &RconClient{}
+	client.InitClient(host, port, server.password)
+
+	var answered int64
+	request := Request{Command: "playerlist", CacheFor: time.Minute}
+	client.SendRequest(request, func(response *Response) {
+		atomic.AddInt64(&answered, 1)
+	})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		client.Disconnect()
+	}()
+
+	if err := client.Connect(done, &wg); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SendRequest(request, func(response *Response) {
+		atomic.AddInt64(&answered, 1)
+	})
+	waitFor(t, "the request to be answered", func() bool { return atomic.LoadInt64(&answered) == 1 })
+
+	if got := atomic.LoadInt64(&server.commands); got != 1 {
+		t.Errorf("server got %d commands, want 1", got)
+	}
+}
@@ -1,5 +1,10 @@
 package webrcon
 
+import (
+	"net"
+	"time"
+)
+
 // Response contains root response format
 type Response struct {
 	Message    string `json:"Message"`
@@ -27,10 +32,12 @@ type Command struct {
 
 // The rest of these are helper structure for well known RCON outputs.
 
-// PlayerList contains the structure for the "playerlist" command in Rust
+// PlayerList contains the structure for the "playerlist" command in Rust.
+// OwnerSteamID is the account that owns the game, if the player is using
+// family sharing, otherwise "0". The misspelt VoiationLevel is Rust's.
 type PlayerList struct {
 	SteamID          string  `json:"SteamID"`
-	OwnerID          string  `json:"OwnerID"`
+	OwnerSteamID     string  `json:"OwnerSteamID"`
 	DisplayName      string  `json:"DisplayName"`
 	Ping             int     `json:"Ping"`
 	Address          string  `json:"Address"`
@@ -40,3 +47,24 @@ type PlayerList struct {
 	UnspentXp        float32 `json:"UnspentXp"`
 	Health           float32 `json:"Health"`
 }
+
+// IP returns the player's address without the port.
+func (p PlayerList) IP() string {
+	host, _, err := net.SplitHostPort(p.Address)
+	if err != nil {
+		return p.Address
+	}
+
+	return host
+}
+
+// Connected returns how long the player has been connected.
+func (p PlayerList) Connected() time.Duration {
+	return time.Duration(p.ConnectedSeconds) * time.Second
+}
+
+// FamilyShared returns whether the player doesn't own the game they're
+// playing.
+func (p PlayerList) FamilyShared() bool {
+	return p.OwnerSteamID != "" && p.OwnerSteamID != "0" && p.OwnerSteamID != p.SteamID
+}
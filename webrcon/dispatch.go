@@ -0,0 +1,155 @@
+package webrcon
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens to a message when an OnMessage
+// callback's buffer is full.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock waits for room in the buffer, holding up the reader and so
+	// every other callback, but never loses a message.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropOldest drops the oldest buffered message to make room.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowDropNewest drops the message that didn't fit.
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+)
+
+// DefaultMessageBuffer is the number of messages buffered per OnMessage
+// callback, unless MessageBuffer is set.
+const DefaultMessageBuffer = 1000
+
+// ParseOverflowPolicy checks policy is a known overflow policy, defaulting to
+// OverflowBlock.
+func ParseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch OverflowPolicy(policy) {
+	case "":
+		return OverflowBlock, nil
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+		return OverflowPolicy(policy), nil
+	}
+
+	return "", fmt.Errorf("unknown overflow policy %s, must be one of block, drop-oldest or drop-newest", policy)
+}
+
+// SubscriberStats are the delivery stats of a single OnMessage callback. Lag
+// is the number of messages waiting in its buffer.
+type SubscriberStats struct {
+	Name             string `json:"name"`
+	Lag              int    `json:"lag"`
+	Delivered        int64  `json:"delivered"`
+	Dropped          int64  `json:"dropped"`
+	ProcessingTimeNs int64  `json:"processing_time_ns"`
+}
+
+// subscriber delivers messages to an OnMessage callback in order, from its own
+// goroutine, through a bounded buffer.
+type subscriber struct {
+	// Counters are first to keep them 64-bit aligned for atomic access.
+	delivered      int64
+	dropped        int64
+	processingTime int64
+	// progressed is the unix time in nanoseconds the callback last started or
+	// finished handling a message, and busy is 1 while it's handling one.
+	progressed int64
+	busy       int32
+	name       string
+	callback   func(message []byte)
+	policy     OverflowPolicy
+	queue      chan []byte
+}
+
+func newSubscriber(cb OnMessageCallback, size int, policy OverflowPolicy) *subscriber {
+	if size <= 0 {
+		size = DefaultMessageBuffer
+	}
+
+	s := &subscriber{
+		name:     cb.Name,
+		callback: cb.Callback,
+		policy:   policy,
+		queue:    make(chan []byte, size),
+	}
+	atomic.StoreInt64(&s.progressed, time.Now().UnixNano())
+	go s.run()
+
+	return s
+}
+
+func (s *subscriber) run() {
+	for message := range s.queue {
+		start := time.Now()
+		atomic.StoreInt64(&s.progressed, start.UnixNano())
+		atomic.StoreInt32(&s.busy, 1)
+
+		s.callback(message)
+
+		atomic.StoreInt32(&s.busy, 0)
+		atomic.StoreInt64(&s.progressed, time.Now().UnixNano())
+		atomic.AddInt64(&s.processingTime, int64(time.Since(start)))
+		atomic.AddInt64(&s.delivered, 1)
+	}
+}
+
+// check returns an error if the callback has a message to handle, or is
+// handling one, and hasn't advanced for longer than grace.
+func (s *subscriber) check(now time.Time, grace time.Duration) error {
+	progressed := time.Unix(0, atomic.LoadInt64(&s.progressed))
+	if now.Sub(progressed) <= grace {
+		return nil
+	}
+
+	if atomic.LoadInt32(&s.busy) == 1 {
+		return fmt.Errorf("onmessage %s has been handling a message since %s", s.name, progressed.Format(time.RFC3339))
+	}
+
+	if lag := len(s.queue); lag > 0 {
+		return fmt.Errorf("onmessage %s has had %d messages waiting since %s", s.name, lag, progressed.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// deliver buffers a message, applying the overflow policy if the buffer is
+// full. Only the reader delivers messages, so there's a single producer.
+func (s *subscriber) deliver(message []byte) {
+	switch s.policy {
+	case OverflowDropNewest:
+		select {
+		case s.queue <- message:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.queue <- message:
+				return
+			default:
+			}
+
+			select {
+			case <-s.queue:
+				atomic.AddInt64(&s.dropped, 1)
+			default:
+			}
+		}
+	default:
+		s.queue <- message
+	}
+}
+
+func (s *subscriber) stats() SubscriberStats {
+	return SubscriberStats{
+		Name:             s.name,
+		Lag:              len(s.queue),
+		Delivered:        atomic.LoadInt64(&s.delivered),
+		Dropped:          atomic.LoadInt64(&s.dropped),
+		ProcessingTimeNs: atomic.LoadInt64(&s.processingTime),
+	}
+}
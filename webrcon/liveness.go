@@ -0,0 +1,58 @@
+package webrcon
+
+import (
+	"fmt"
+	"time"
+)
+
+// runningCallback is a command callback that's still running.
+type runningCallback struct {
+	command string
+	started time.Time
+}
+
+// runCallback calls a command callback from its own goroutine, tracking it
+// until it returns so Check can tell if it's stuck.
+func (client *RconClient) runCallback(command string, callback func(response *Response), response *Response) {
+	client.cmu.Lock()
+	client.runningID++
+	id := client.runningID
+	client.running[id] = runningCallback{command: command, started: time.Now()}
+	client.cmu.Unlock()
+
+	go func() {
+		defer func() {
+			client.cmu.Lock()
+			delete(client.running, id)
+			client.cmu.Unlock()
+		}()
+
+		callback(response)
+	}()
+}
+
+// Check returns an error if message handling has stopped advancing: an
+// OnMessage callback has been handling a message, or has had messages
+// waiting, for longer than grace without getting through one, or a command
+// callback has been running for longer than grace. Either means a script is
+// stuck, e.g. on a lock, and with the block overflow policy the reader is
+// stuck behind it.
+func (client *RconClient) Check(grace time.Duration) error {
+	now := time.Now()
+	for _, s := range client.onmessage {
+		if err := s.check(now, grace); err != nil {
+			return err
+		}
+	}
+
+	client.cmu.Lock()
+	defer client.cmu.Unlock()
+
+	for _, cb := range client.running {
+		if now.Sub(cb.started) > grace {
+			return fmt.Errorf("the callback for %s has been running since %s", cb.command, cb.started.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package webrcon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Frame directions in a recording
+const (
+	FrameIn  = "in"
+	FrameOut = "out"
+)
+
+// maxFrameSize is the largest frame read back from a recording, some command
+// responses (e.g. playerlist on a full server) are quite large.
+const maxFrameSize = 64 * 1024 * 1024
+
+// Frame is a single recorded WebRCON frame.
+type Frame struct {
+	Time      int64           `json:"time"`
+	Direction string          `json:"direction"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Recorder writes every WebRCON frame sent or received to a file, as one JSON
+// object per line.
+type Recorder struct {
+	Path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewRecorder opens the recording file, appending to it if it exists.
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	zap.S().Infof("Recording RCON session to %s", path)
+
+	return &Recorder{Path: path, file: file}, nil
+}
+
+// Record writes a single frame.
+func (r *Recorder) Record(direction string, data []byte) {
+	frame := Frame{Time: time.Now().UnixNano(), Direction: direction, Data: data}
+	if !json.Valid(data) {
+		frame.Data, _ = json.Marshal(string(data))
+	}
+
+	line, err := json.Marshal(frame)
+	if err != nil {
+		zap.S().Errorf("Error encoding frame for recording: %s", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		zap.S().Errorf("Error writing to recording %s: %s", r.Path, err)
+	}
+}
+
+// Close closes the recording, any further frames are dropped.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+
+	return err
+}
+
+// CloseOnDone is intended to be run as a goroutine, and closes the recording
+// on shutdown.
+func (r *Recorder) CloseOnDone(done chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	defer wg.Done()
+
+	<-done
+	if err := r.Close(); err != nil {
+		zap.S().Errorf("Error closing recording %s: %s", r.Path, err)
+	}
+}
+
+// ReadRecording reads every frame from a recording.
+func ReadRecording(path string) ([]Frame, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var frames []Frame
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxFrameSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var frame Frame
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		frames = append(frames, frame)
+	}
+
+	return frames, scanner.Err()
+}
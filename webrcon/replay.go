@@ -0,0 +1,204 @@
+package webrcon
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// replaySession holds the recorded responses to every command, so commands
+// sent while replaying can be answered the way the server answered them. The
+// answers are queued for the replay loop to handle, keeping it the only
+// goroutine handling messages, the same as the reader is when connected.
+type replaySession struct {
+	mu        sync.Mutex
+	responses map[string][]Response
+	next      map[string]int
+	queued    [][]byte
+	wake      chan struct{}
+}
+
+func newReplaySession(frames []Frame) *replaySession {
+	session := &replaySession{
+		responses: make(map[string][]Response),
+		next:      make(map[string]int),
+		wake:      make(chan struct{}, 1),
+	}
+
+	commands := make(map[int]string)
+	for _, frame := range frames {
+		switch frame.Direction {
+		case FrameOut:
+			var cmd Command
+			if err := json.Unmarshal(frame.Data, &cmd); err == nil && cmd.Identifier >= StartingIdentifier {
+				commands[cmd.Identifier] = cmd.Message
+			}
+		case FrameIn:
+			var r Response
+			if err := json.Unmarshal(frame.Data, &r); err != nil || r.Identifier < StartingIdentifier {
+				continue
+			}
+			if command, ok := commands[r.Identifier]; ok {
+				session.responses[command] = append(session.responses[command], r)
+			}
+		}
+	}
+
+	return session
+}
+
+// response returns the next recorded response to command, cycling through
+// them in the order they were recorded.
+func (session *replaySession) response(command string) (Response, bool) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	responses := session.responses[command]
+	if len(responses) == 0 {
+		return Response{}, false
+	}
+
+	i := session.next[command]
+	session.next[command] = (i + 1) % len(responses)
+
+	return responses[i], true
+}
+
+// queue queues a message for the replay loop, waking it up.
+func (session *replaySession) queue(message []byte) {
+	session.mu.Lock()
+	session.queued = append(session.queued, message)
+	session.mu.Unlock()
+
+	select {
+	case session.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the queued messages, emptying the queue.
+func (session *replaySession) take() [][]byte {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	queued := session.queued
+	session.queued = nil
+
+	return queued
+}
+
+// replaySession returns the replay session, or nil if the client isn't
+// replaying.
+func (client *RconClient) replaySession() *replaySession {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return client.replay
+}
+
+func (client *RconClient) replayCommand(session *replaySession, command string, callback func(response *Response)) (int, bool) {
+	recorded, ok := session.response(command)
+	if !ok {
+		zap.S().Warnf("REPLAY: No recorded response to %s, ignoring.", command)
+		return 0, false
+	}
+
+	client.cmu.Lock()
+	client.identifier++
+	identifier := client.identifier
+	client.callbacks[identifier] = RconCallback{
+		command:   command,
+		ttl:       10,
+		timestamp: time.Now().Unix(),
+		callback:  callback}
+	client.cmu.Unlock()
+
+	atomic.AddInt64(&client.stats.CommandsRun, 1)
+
+	recorded.Identifier = identifier
+	message, err := json.Marshal(&recorded)
+	if err != nil {
+		zap.S().Errorf("REPLAY: Error encoding recorded response to %s: %s", command, err)
+		return identifier, true
+	}
+
+	session.queue(message)
+
+	return identifier, true
+}
+
+// replayUntil handles the answers to commands sent while replaying until wait
+// fires. Returns false if done was closed.
+func (client *RconClient) replayUntil(session *replaySession, wait <-chan time.Time, done chan struct{}) bool {
+	for {
+		for _, message := range session.take() {
+			client.handleMessage(message)
+		}
+
+		select {
+		case <-done:
+			return false
+		case <-wait:
+			return true
+		case <-session.wake:
+		}
+	}
+}
+
+// Replay feeds a recording through the client as if it were being received
+// from the server, running the OnMessage callbacks on every message. Commands
+// sent while replaying are answered with the recorded response to the same
+// command instead of being sent. Speed scales the delays between messages, 1
+// replays at the original speed, 10 ten times faster, and 0 as fast as
+// possible. Commands are still answered for linger after the recording ends,
+// so they can finish. Returns once linger has passed, or done is closed.
+func (client *RconClient) Replay(frames []Frame, speed float64, linger time.Duration, done chan struct{}) {
+	session := newReplaySession(frames)
+
+	client.mu.Lock()
+	client.replay = session
+	client.mu.Unlock()
+	client.setConnected(true)
+
+	// Frames without a delay are replayed straight away.
+	now := make(chan time.Time)
+	close(now)
+
+	zap.S().Infof("REPLAY: Replaying %d frames.", len(frames))
+
+	var last int64
+	for _, frame := range frames {
+		if frame.Direction != FrameIn {
+			continue
+		}
+
+		// Command responses are replayed when the command is sent.
+		var r Response
+		if err := json.Unmarshal(frame.Data, &r); err == nil && r.Identifier >= StartingIdentifier {
+			continue
+		}
+
+		if speed > 0 && last > 0 && frame.Time > last {
+			timer := time.NewTimer(time.Duration(float64(frame.Time-last) / speed))
+			replaying := client.replayUntil(session, timer.C, done)
+			timer.Stop()
+			if !replaying {
+				return
+			}
+		} else if !client.replayUntil(session, now, done) {
+			return
+		}
+		last = frame.Time
+
+		client.handleMessage(frame.Data)
+	}
+
+	zap.S().Info("REPLAY: Finished replaying recording.")
+
+	timer := time.NewTimer(linger)
+	defer timer.Stop()
+	client.replayUntil(session, timer.C, done)
+}